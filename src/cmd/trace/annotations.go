@@ -2,16 +2,20 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"internal/trace"
 	"log"
 	"math"
 	"net/http"
+	"net/url"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,6 +24,7 @@ func init() {
 	http.HandleFunc("/usertask", httpUserTask)
 	http.HandleFunc("/userspans", httpUserSpans)
 	http.HandleFunc("/userspan", httpUserSpan)
+	http.HandleFunc("/spanlist", httpSpanList)
 }
 
 // httpUserTasks reports all tasks found in the trace.
@@ -97,6 +102,65 @@ func httpUserSpans(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// spanListParams describes the span filter parameters of the span profiles,
+// as parsed by newSpanFilter, for /spanlist.
+var spanListParams = map[string]string{
+	"type":      "span type, that is the span name, matched exactly",
+	"name":      "regular expression matching the span name",
+	"pc":        "PC of the frame that started the span, in hexadecimal",
+	"latmin":    "minimum span duration, such as 10ms",
+	"latmax":    "maximum span duration, such as 1s",
+	"firstonly": "1 to keep only the earliest-starting matching span of each name",
+}
+
+// spanListEntry summarizes the spans of a type for /spanlist,
+// with the parameters selecting them in the span profiles.
+type spanListEntry struct {
+	Type    string `json:"type"`    // Span type, that is the span name.
+	Func    string `json:"func"`    // Function that started the spans.
+	PC      string `json:"pc"`      // PC of the frame that started the spans, in hexadecimal.
+	N       int    `json:"count"`   // Number of spans.
+	Query   string `json:"query"`   // Query parameters selecting the spans.
+	Example string `json:"example"` // URL of the span blocking profile of the spans.
+}
+
+// httpSpanList serves the types of the spans in the trace, with the query
+// parameters selecting them in the /span<kind> profiles, as JSON.
+func httpSpanList(w http.ResponseWriter, r *http.Request) {
+	res, err := analyzeAnnotations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list := make([]spanListEntry, 0, len(res.spans))
+	for id, spans := range res.spans {
+		pc := fmt.Sprintf("%x", id.Frame.PC)
+		query := url.Values{"type": {id.Type}, "pc": {pc}}.Encode()
+		list = append(list, spanListEntry{
+			Type:    id.Type,
+			Func:    id.Frame.Fn,
+			PC:      pc,
+			N:       len(spans),
+			Query:   query,
+			Example: "/spanblock?" + query,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Type != list[j].Type {
+			return list[i].Type < list[j].Type
+		}
+		return list[i].PC < list[j].PC
+	})
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		Params map[string]string `json:"params"`
+		Spans  []spanListEntry   `json:"spans"`
+	}{spanListParams, list})
+	if err != nil {
+		log.Printf("failed to encode span list: %v", err)
+	}
+}
+
 func httpUserSpan(w http.ResponseWriter, r *http.Request) {
 	filter, err := newSpanFilter(r)
 	if err != nil {
@@ -264,9 +328,25 @@ type spanTypeID struct {
 	Type  string
 }
 
+var annotations struct {
+	once sync.Once
+	res  annotationAnalysisResult
+	err  error
+}
+
 // analyzeAnnotations analyzes user annotation events and
 // returns the task descriptors keyed by internal task id.
+// The analysis is done once and the result is reused by
+// subsequent calls since the trace does not change.
 func analyzeAnnotations() (annotationAnalysisResult, error) {
+	annotations.once.Do(func() {
+		annotations.res, annotations.err = computeAnnotations()
+	})
+	return annotations.res, annotations.err
+}
+
+// computeAnnotations does the work of analyzeAnnotations.
+func computeAnnotations() (annotationAnalysisResult, error) {
 	res, err := parseTrace()
 	if err != nil {
 		return annotationAnalysisResult{}, fmt.Errorf("failed to parse trace: %v", err)
@@ -304,11 +384,7 @@ func analyzeAnnotations() (annotationAnalysisResult, error) {
 		}
 	}
 	// combine span info.
-	analyzeGoroutines(events)
-	for goid, stats := range gs {
-		// gs is a global var defined in goroutines.go as a result
-		// of analyzeGoroutines. TODO(hyangah): fix this not to depend
-		// on a 'global' var.
+	for goid, stats := range analyzeGoroutines(events) {
 		for _, s := range stats.Spans {
 			if s.TaskID != 0 {
 				task := tasks.task(s.TaskID)
@@ -735,6 +811,10 @@ func taskMatches(t *taskDesc, text string) bool {
 type spanFilter struct {
 	name string
 	cond []func(spanTypeID, spanDesc) bool
+
+	// firstOnly keeps, of the matching spans of each name,
+	// only the earliest-starting one; see pprofMatchingSpans.
+	firstOnly bool
 }
 
 func (f *spanFilter) match(id spanTypeID, s spanDesc) bool {
@@ -761,27 +841,100 @@ func newSpanFilter(r *http.Request) (*spanFilter, error) {
 			return id.Type == typ[0]
 		})
 	}
-	if pc, err := strconv.ParseUint(r.FormValue("pc"), 16, 64); err == nil {
+	if v := r.FormValue("name"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, &spanFilterError{param: "name", value: v, err: err}
+		}
+		name = append(name, "name=~"+v)
+		conditions = append(conditions, func(_ spanTypeID, s spanDesc) bool {
+			return re.MatchString(s.Name)
+		})
+	}
+	if v := r.FormValue("pc"); v != "" {
+		pc, err := strconv.ParseUint(v, 16, 64)
+		if err != nil {
+			return nil, &spanFilterError{param: "pc", value: v}
+		}
 		name = append(name, fmt.Sprintf("pc=%x", pc))
 		conditions = append(conditions, func(id spanTypeID, s spanDesc) bool {
 			return id.Frame.PC == pc
 		})
 	}
 
-	if lat, err := time.ParseDuration(r.FormValue("latmin")); err == nil {
-		name = append(name, fmt.Sprintf("latency >= %s", lat))
+	latmin, err := parseSpanLatency(r, "latmin")
+	if err != nil {
+		return nil, err
+	}
+	if latmin >= 0 {
+		name = append(name, fmt.Sprintf("latency >= %s", latmin))
 		conditions = append(conditions, func(_ spanTypeID, s spanDesc) bool {
-			return s.duration() >= lat
+			return s.duration() >= latmin
 		})
 	}
-	if lat, err := time.ParseDuration(r.FormValue("latmax")); err == nil {
-		name = append(name, fmt.Sprintf("latency <= %s", lat))
+	latmax, err := parseSpanLatency(r, "latmax")
+	if err != nil {
+		return nil, err
+	}
+	if latmax >= 0 {
+		if latmax < latmin {
+			return nil, &spanFilterError{param: "latmax", value: r.FormValue("latmax"), err: fmt.Errorf("below latmin %s", latmin)}
+		}
+		name = append(name, fmt.Sprintf("latency <= %s", latmax))
 		conditions = append(conditions, func(_ spanTypeID, s spanDesc) bool {
-			return s.duration() <= lat
+			return s.duration() <= latmax
 		})
 	}
+	var firstOnly bool
+	switch v := r.FormValue("firstonly"); v {
+	case "", "0":
+	case "1":
+		name = append(name, "first only")
+		firstOnly = true
+	default:
+		return nil, &spanFilterError{param: "firstonly", value: v}
+	}
+
+	return &spanFilter{name: strings.Join(name, ","), cond: conditions, firstOnly: firstOnly}, nil
+}
 
-	return &spanFilter{name: strings.Join(name, ","), cond: conditions}, nil
+// parseSpanLatency parses the span duration in the named request parameter.
+// It returns -1 if the parameter is not set.
+func parseSpanLatency(r *http.Request, param string) (time.Duration, error) {
+	v := r.FormValue(param)
+	if v == "" {
+		return -1, nil
+	}
+	lat, err := time.ParseDuration(v)
+	if err != nil || lat < 0 {
+		return 0, &spanFilterError{param: param, value: v}
+	}
+	return lat, nil
+}
+
+// spanFilterError reports a malformed span filter parameter, with the
+// expected format from spanListParams and an example URL using it.
+type spanFilterError struct {
+	param, value string
+	err          error // the parse error, if it tells more than the format.
+}
+
+// spanFilterExamples are example values of the span filter parameters.
+var spanFilterExamples = map[string]string{
+	"name":      "^rpc",
+	"pc":        "4a5b3c",
+	"latmin":    "10ms",
+	"latmax":    "1s",
+	"firstonly": "1",
+}
+
+func (e *spanFilterError) Error() string {
+	msg := fmt.Sprintf("invalid %s parameter %q", e.param, e.value)
+	if e.err != nil {
+		msg += fmt.Sprintf(" (%v)", e.err)
+	}
+	example := url.Values{e.param: {spanFilterExamples[e.param]}}.Encode()
+	return fmt.Sprintf("%s: want %s, as in /spanblock?%s", msg, spanListParams[e.param], example)
 }
 
 type durationHistogram struct {
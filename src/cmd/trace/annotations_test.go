@@ -1,19 +1,28 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	traceparser "internal/trace"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"runtime/debug"
 	"runtime/trace"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/google/pprof/profile"
 )
 
 var saveTraces = flag.Bool("savetraces", false, "save traces collected by tests")
@@ -370,10 +379,14 @@ func swapLoaderData(res traceparser.ParseResult, err error) {
 
 	loader.res = res
 	loader.err = err
+	loader.traces = []traceparser.ParseResult{res}
+	loader.names = []string{"0"}
 
 	analyzeGoroutines(nil) // fool gsInit once.
 	gs = traceparser.GoroutineStats(res.Events)
 
+	analyzeAnnotations() // fool annotations once.
+	annotations.res, annotations.err = computeAnnotations()
 }
 
 func saveTrace(buf *bytes.Buffer, name string) {
@@ -384,3 +397,719 @@ func saveTrace(buf *bytes.Buffer, name string) {
 		panic(fmt.Errorf("failed to write trace file: %v", err))
 	}
 }
+
+func TestSpanFilterName(t *testing.T) {
+	r := httptest.NewRequest("GET", "/userspan?name=%5Edb%5C.", nil)
+	filter, err := newSpanFilter(r)
+	if err != nil {
+		t.Fatalf("newSpanFilter failed: %v", err)
+	}
+	for name, want := range map[string]bool{"db.query": true, "db.exec": true, "http.db.query": false, "dbquery": false} {
+		s := spanDesc{UserSpanDesc: &traceparser.UserSpanDesc{Name: name}}
+		if got := filter.match(spanTypeID{Type: name}, s); got != want {
+			t.Errorf("match(%q) = %v; want %v", name, got, want)
+		}
+	}
+
+	r = httptest.NewRequest("GET", "/userspan?name=(", nil)
+	if _, err := newSpanFilter(r); err == nil {
+		t.Errorf("newSpanFilter succeeded with an invalid name parameter")
+	}
+}
+
+// TestSpanFilterLatency tests that the latmin parameter keeps
+// only the spans lasting at least the given duration.
+func TestSpanFilterLatency(t *testing.T) {
+	r := httptest.NewRequest("GET", "/spanblock?type=db&latmin=100ms", nil)
+	filter, err := newSpanFilter(r)
+	if err != nil {
+		t.Fatalf("newSpanFilter failed: %v", err)
+	}
+	for d, want := range map[time.Duration]bool{50 * time.Millisecond: false, 100 * time.Millisecond: true, time.Second: true} {
+		s := spanDesc{UserSpanDesc: &traceparser.UserSpanDesc{
+			Name:  "db",
+			Start: &traceparser.Event{Ts: 0},
+			End:   &traceparser.Event{Ts: int64(d)},
+		}}
+		if got := filter.match(spanTypeID{Type: "db"}, s); got != want {
+			t.Errorf("match(span of %v) = %v; want %v", d, got, want)
+		}
+	}
+}
+
+func TestPprofMatchingTask(t *testing.T) {
+	if err := traceProgram(t, prog1, "TestPprofMatchingTask"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	res, err := analyzeAnnotations()
+	if err != nil {
+		t.Fatalf("failed to analyzeAnnotations: %v", err)
+	}
+	var task1, task3 *taskDesc
+	for _, task := range res.tasks {
+		switch task.name {
+		case "task1":
+			task1 = task
+		case "task3":
+			task3 = task
+		}
+	}
+	if task1 == nil || task3 == nil {
+		t.Fatalf("failed to find the tasks task1 and task3")
+	}
+
+	r := httptest.NewRequest("GET", fmt.Sprintf("/block?task=%d", task1.id), nil)
+	gToIntervals, err := pprofMatchingTask(r, nil)
+	if err != nil {
+		t.Fatalf("pprofMatchingTask failed: %v", err)
+	}
+	// The spans of task1 and its descendant tasks are nested,
+	// so they are merged into the interval of the outermost one.
+	for g, intervals := range gToIntervals {
+		if len(intervals) != 1 {
+			t.Errorf("goroutine %d: got intervals %v; want one", g, intervals)
+			continue
+		}
+		for _, s := range task3.spans {
+			if s.G == g && (s.firstTimestamp() < intervals[0].begin || s.lastTimestamp() > intervals[0].end) {
+				t.Errorf("goroutine %d: intervals %v do not include span %v of the descendant task", g, intervals, s.Name)
+			}
+		}
+	}
+	if len(gToIntervals) == 0 {
+		t.Errorf("got no intervals for task1")
+	}
+
+	r = httptest.NewRequest("GET", "/block?task=12345678", nil)
+	if _, err := pprofMatchingTask(r, nil); err == nil {
+		t.Errorf("pprofMatchingTask succeeded with an unknown task")
+	}
+	r = httptest.NewRequest("GET", "/block?task=x", nil)
+	if _, err := pprofMatchingTask(r, nil); err == nil {
+		t.Errorf("pprofMatchingTask succeeded with an invalid task parameter")
+	} else if _, ok := err.(*paramError); !ok {
+		t.Errorf("got error %#v for an invalid task parameter; want a parameter error", err)
+	}
+}
+
+func TestPprofMatchingGoroutineSpans(t *testing.T) {
+	if err := traceProgram(t, prog1, "TestPprofMatchingGoroutineSpans"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	res, err := analyzeAnnotations()
+	if err != nil {
+		t.Fatalf("failed to analyzeAnnotations: %v", err)
+	}
+	var span *spanDesc
+	for id, spans := range res.spans {
+		if id.Type == "task2.span" {
+			span = &spans[0]
+		}
+	}
+	if span == nil {
+		t.Fatalf("failed to find the span task2.span")
+	}
+	r := httptest.NewRequest("GET", "/block?type=task2.span", nil)
+
+	// The goroutine intervals partially overlap the span.
+	begin, end := span.firstTimestamp(), span.lastTimestamp()
+	gToIntervals := map[uint64][]interval{span.G: {{begin: begin + 1, end: end + 1}}}
+	got, err := pprofMatchingGoroutineSpans(r, gToIntervals, false)
+	if err != nil {
+		t.Fatalf("pprofMatchingGoroutineSpans failed: %v", err)
+	}
+	want := map[uint64][]interval{span.G: {{begin: begin + 1, end: end}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got intervals %v; want %v", got, want)
+	}
+
+	// The span is not on any of the goroutines.
+	gToIntervals = map[uint64][]interval{span.G + 1: {{begin: begin, end: end}}}
+	if got, err := pprofMatchingGoroutineSpans(r, gToIntervals, false); err != nil || len(got) != 0 {
+		t.Errorf("got intervals %v, %v; want none", got, err)
+	}
+}
+
+func TestPprofCreatedAfter(t *testing.T) {
+	if err := traceProgram(t, prog1, "TestPprofCreatedAfter"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	base := firstTimestamp()
+	gs = map[uint64]*traceparser.GDesc{
+		1: {ID: 1, StartTime: base},
+		2: {ID: 2, StartTime: base + 100, EndTime: base + 200},
+	}
+	r := httptest.NewRequest("GET", "/block?createdafter=50", nil)
+	got, err := pprofCreatedAfter(r, nil, nil)
+	if err != nil {
+		t.Fatalf("pprofCreatedAfter failed: %v", err)
+	}
+	if want := map[uint64][]interval{2: {{begin: base + 100, end: base + 200}}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got intervals %v; want %v", got, want)
+	}
+	// Goroutine 2 is not of the selected type.
+	got, err = pprofCreatedAfter(r, map[uint64][]interval{1: {{begin: base, end: base + 10}}}, nil)
+	if err != nil || len(got) != 0 {
+		t.Errorf("got intervals %v, %v; want none", got, err)
+	}
+
+	r = httptest.NewRequest("GET", "/block?createdafter=x", nil)
+	if _, err := pprofCreatedAfter(r, nil, nil); err == nil {
+		t.Errorf("pprofCreatedAfter succeeded with an invalid createdafter parameter")
+	} else if _, ok := err.(*paramError); !ok {
+		t.Errorf("got error %#v for an invalid createdafter parameter; want a parameter error", err)
+	}
+}
+
+func TestPprofMatchingGoroutineIDs(t *testing.T) {
+	if err := traceProgram(t, prog1, "TestPprofMatchingGoroutineIDs"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	base := firstTimestamp()
+	gs = map[uint64]*traceparser.GDesc{
+		1: {ID: 1, StartTime: base, EndTime: base + 10},
+		2: {ID: 2, StartTime: base + 100, EndTime: base + 200},
+		3: {ID: 3, StartTime: base + 100, EndTime: base + 300},
+	}
+	r := httptest.NewRequest("GET", "/block?gids=1,%203", nil)
+	got, err := pprofMatchingGoroutineIDs(r, nil, nil)
+	if err != nil {
+		t.Fatalf("pprofMatchingGoroutineIDs failed: %v", err)
+	}
+	want := map[uint64][]interval{
+		1: {{begin: base, end: base + 10}},
+		3: {{begin: base + 100, end: base + 300}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got intervals %v; want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		url   string
+		param bool // whether the error is a parameter error.
+	}{
+		{"/block?gids=1,x", true},
+		{"/block?gids=4", false},
+	} {
+		_, err := pprofMatchingGoroutineIDs(httptest.NewRequest("GET", tc.url, nil), nil, nil)
+		if err == nil {
+			t.Errorf("%s: pprofMatchingGoroutineIDs succeeded", tc.url)
+		} else if _, ok := err.(*paramError); ok != tc.param {
+			t.Errorf("%s: got error %#v; want a parameter error: %v", tc.url, err, tc.param)
+		}
+	}
+}
+
+func TestPprofMatchingGoroutinesList(t *testing.T) {
+	if err := traceProgram(t, prog1, "TestPprofMatchingGoroutinesList"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	base := firstTimestamp()
+	gs = map[uint64]*traceparser.GDesc{
+		1: {ID: 1, PC: 100, StartTime: base, EndTime: base + 10},
+		2: {ID: 2, PC: 200, StartTime: base + 100, EndTime: base + 200},
+		3: {ID: 3, PC: 300, StartTime: base + 100, EndTime: base + 300},
+	}
+	got, err := pprofMatchingGoroutines("100, 300,400", nil)
+	if err != nil {
+		t.Fatalf("pprofMatchingGoroutines failed: %v", err)
+	}
+	want := map[uint64][]interval{
+		1: {{begin: base, end: base + 10}},
+		3: {{begin: base + 100, end: base + 300}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got intervals %v; want %v", got, want)
+	}
+
+	for _, id := range []string{"100,x", "400,500"} {
+		if _, err := pprofMatchingGoroutines(id, nil); err == nil {
+			t.Errorf("%s: pprofMatchingGoroutines succeeded", id)
+		}
+	}
+}
+
+func TestPprofMatchingGoroutineNames(t *testing.T) {
+	if err := traceProgram(t, prog1, "TestPprofMatchingGoroutineNames"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	base := firstTimestamp()
+	gs = map[uint64]*traceparser.GDesc{
+		1: {ID: 1, Name: "main.worker", StartTime: base, EndTime: base + 10},
+		2: {ID: 2, Name: "main.workerPool.run", StartTime: base, EndTime: base + 20},
+		3: {ID: 3, Name: "net/http.(*conn).serve", StartTime: base, EndTime: base + 30},
+	}
+	r := httptest.NewRequest("GET", "/block?gname=%5Emain%5C.worker", nil)
+	got, err := pprofMatchingGoroutineNames(r, nil, nil)
+	if err != nil {
+		t.Fatalf("pprofMatchingGoroutineNames failed: %v", err)
+	}
+	want := map[uint64][]interval{
+		1: {{begin: base, end: base + 10}},
+		2: {{begin: base, end: base + 20}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got intervals %v; want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		url   string
+		param bool // whether the error is a parameter error.
+	}{
+		{"/block?gname=(", true},
+		{"/block?gname=nomatch", false},
+	} {
+		_, err := pprofMatchingGoroutineNames(httptest.NewRequest("GET", tc.url, nil), nil, nil)
+		if err == nil {
+			t.Errorf("%s: pprofMatchingGoroutineNames succeeded", tc.url)
+		} else if _, ok := err.(*paramError); ok != tc.param {
+			t.Errorf("%s: got error %#v; want a parameter error: %v", tc.url, err, tc.param)
+		}
+	}
+}
+
+func TestGoroutineInterval(t *testing.T) {
+	if err := traceProgram(t, prog1, "TestGoroutineInterval"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	base, last := firstTimestamp(), lastTimestamp()
+	for _, tc := range []struct {
+		g    traceparser.GDesc
+		want interval
+	}{
+		{traceparser.GDesc{StartTime: base + 10, EndTime: base + 20}, interval{base + 10, base + 20}},
+		{traceparser.GDesc{StartTime: base + 10}, interval{base + 10, last}},
+		// Created in the trace but never started.
+		{traceparser.GDesc{CreationTime: base + 5}, interval{base + 5, last}},
+		// Existed before the trace start.
+		{traceparser.GDesc{EndTime: base + 20}, interval{base, base + 20}},
+	} {
+		if got := goroutineInterval(&tc.g); got != tc.want {
+			t.Errorf("goroutineInterval(start %d, creation %d, end %d) = %v; want %v",
+				tc.g.StartTime, tc.g.CreationTime, tc.g.EndTime, got, tc.want)
+		}
+	}
+
+	// The events of a goroutine before it was created are not counted.
+	g := &traceparser.GDesc{ID: 1, CreationTime: base + 10}
+	events := []*traceparser.Event{blockEvent(1, base, base+30, 1, "main.f")}
+	p, err := computeProfile(profileBlock, events, map[uint64][]interval{1: {goroutineInterval(g)}}, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 || p.Sample[0].Value[1] != 20 {
+		t.Errorf("got samples %v; want one with a delay of 20", p.Sample)
+	}
+}
+
+func TestPprofBySpanParseError(t *testing.T) {
+	if err := traceProgram(t, prog1, "TestPprofBySpanParseError"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	// The annotations are already analyzed; only the events fail to parse.
+	defer func(err error) { loader.err = err }(loader.err)
+	loader.err = fmt.Errorf("corrupted trace")
+
+	called := false
+	handler := pprofBySpan(func(w io.Writer, gToIntervals map[uint64][]interval, events []*traceparser.Event, opts *pprofOptions) error {
+		called = true
+		return nil
+	})
+	err := handler(ioutil.Discard, httptest.NewRequest("GET", "/spanblock?type=taskless.span0", nil))
+	if err == nil || err.Error() != "corrupted trace" {
+		t.Errorf("got error %v; want the parse error", err)
+	}
+	if called {
+		t.Errorf("the profile was computed without events")
+	}
+}
+
+func TestSpanList(t *testing.T) {
+	if err := traceProgram(t, prog1, "TestSpanList"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	httpSpanList(rec, httptest.NewRequest("GET", "/spanlist", nil))
+	var list struct {
+		Params map[string]string
+		Spans  []spanListEntry
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode span list: %v", err)
+	}
+	if !reflect.DeepEqual(list.Params, spanListParams) {
+		t.Errorf("got params %v; want %v", list.Params, spanListParams)
+	}
+	var types []string
+	for _, s := range list.Spans {
+		types = append(types, s.Type)
+		filter, err := newSpanFilter(httptest.NewRequest("GET", s.Example, nil))
+		if err != nil {
+			t.Fatalf("%s: %v", s.Example, err)
+		}
+		gToIntervals, err := pprofMatchingSpans(filter, true)
+		if err != nil {
+			t.Fatalf("%s: %v", s.Example, err)
+		}
+		n := 0
+		for _, intervals := range gToIntervals {
+			n += len(intervals)
+		}
+		if n != s.N {
+			t.Errorf("%s: selects %d spans; want %d", s.Example, n, s.N)
+		}
+	}
+	if want := []string{"task1.span", "task2.span", "task3.span"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("got span types %v; want %v", types, want)
+	}
+}
+
+func TestProfilesZip(t *testing.T) {
+	if err := traceProgram(t, prog1, "TestProfilesZip"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	serveProfilesZip(rec, httptest.NewRequest("GET", "/profiles.zip", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("failed to read zip file: %v", err)
+	}
+	if len(zr.File) != len(zipProfileKinds) {
+		t.Fatalf("zip file has %d files; want %d", len(zr.File), len(zipProfileKinds))
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		if strings.HasSuffix(f.Name, ".error.txt") {
+			msg, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil || len(msg) == 0 {
+				t.Errorf("%s: got %q, %v; want the error", f.Name, msg, err)
+			}
+			continue
+		}
+		p, err := profile.Parse(rc)
+		rc.Close()
+		if err != nil {
+			t.Errorf("%s: failed to parse profile: %v", f.Name, err)
+			continue
+		}
+		if want := "kind: " + strings.TrimSuffix(f.Name, ".pb.gz"); p.Comments[1] != want {
+			t.Errorf("%s: got comment %q; want %q", f.Name, p.Comments[1], want)
+		}
+	}
+
+	// No events on P 999: every profile is replaced by its error.
+	rec = httptest.NewRecorder()
+	serveProfilesZip(rec, httptest.NewRequest("GET", "/profiles.zip?p=999", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	zr, err = zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("failed to read zip file: %v", err)
+	}
+	for i, f := range zr.File {
+		if want := zipProfileKinds[i].String() + ".error.txt"; f.Name != want {
+			t.Errorf("got file %s; want %s", f.Name, want)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	serveProfilesZip(rec, httptest.NewRequest("GET", "/profiles.zip?id=x", nil))
+	if rec.Code == http.StatusOK {
+		t.Errorf("invalid filter: got status %d", rec.Code)
+	}
+}
+
+func TestOverlappingDurationTraceWide(t *testing.T) {
+	if err := traceProgram(t, prog1, "TestOverlappingDurationTraceWide"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	events, err := parseEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Intervals covering the whole trace, from time zero or from its start,
+	// must account for as much time as no filter at all.
+	for _, begin := range []int64{0, firstTimestamp()} {
+		gToIntervals := make(map[uint64][]interval)
+		for _, ev := range events {
+			gToIntervals[ev.G] = []interval{{begin: begin, end: lastTimestamp()}}
+			if ev.Type == traceparser.EvGoCreate {
+				// The goroutine may not run in the trace.
+				gToIntervals[ev.Args[0]] = []interval{{begin: begin, end: lastTimestamp()}}
+			}
+		}
+		for _, ev := range events {
+			if want, got := pprofOverlappingDuration(nil, ev), pprofOverlappingDuration(gToIntervals, ev); got != want {
+				t.Errorf("begin %d: %v: got overlapping duration %v; want %v as without filter", begin, ev, got, want)
+			}
+		}
+		for name, k := range profileKinds {
+			want, err := computeProfile(k.kind, events, nil, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			got, err := computeProfile(k.kind, events, gToIntervals, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if g, w := totalDelay(got), totalDelay(want); g != w {
+				t.Errorf("begin %d: %s profile: got total delay %d; want %d as without filter", begin, name, g, w)
+			}
+		}
+	}
+}
+
+// totalDelay returns the sum of the delay values of the samples of p.
+func totalDelay(p *profile.Profile) int64 {
+	var total int64
+	for _, s := range p.Sample {
+		total += s.Value[1]
+	}
+	return total
+}
+
+// TestBlockIntervalsDisjoint checks that the blocking intervals of a
+// goroutine never overlap: a goroutine blocks in a single event at a time,
+// at the stack of its innermost blocking call, so the block profile already
+// accounts each blocked interval once, as self time.
+func TestBlockIntervalsDisjoint(t *testing.T) {
+	prog := func() {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		c := make(chan int)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					mu.Lock()
+					time.Sleep(10 * time.Microsecond)
+					mu.Unlock()
+					select {
+					case c <- j:
+					case <-time.After(10 * time.Microsecond):
+					}
+				}
+			}()
+		}
+		go func() {
+			for range c {
+			}
+		}()
+		wg.Wait()
+		close(c)
+	}
+	if err := traceProgram(t, prog, "TestBlockIntervalsDisjoint"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	events, err := parseEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked := make(map[uint64]int64) // goroutine id to the end of its last blocking event
+	n := 0
+	for _, ev := range selectEvents(events, profileKinds["block"].types) {
+		if ev.Link == nil {
+			continue
+		}
+		n++
+		if end, ok := blocked[ev.G]; ok && ev.Ts < end {
+			t.Errorf("goroutine %d blocks at %d before the end of its previous blocking at %d", ev.G, ev.Ts, end)
+		}
+		blocked[ev.G] = ev.Link.Ts
+	}
+	if n == 0 {
+		t.Skip("the program did not block")
+	}
+}
+
+func TestSpanFilterFirstOnly(t *testing.T) {
+	prog := func() {
+		ctx := context.Background()
+		for i := 0; i < 3; i++ {
+			trace.WithSpan(ctx, "work", func(ctx context.Context) {
+				time.Sleep(time.Millisecond)
+			})
+		}
+		trace.WithSpan(ctx, "other", func(ctx context.Context) {})
+	}
+	if err := traceProgram(t, prog, "TestSpanFilterFirstOnly"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	res, err := analyzeAnnotations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first *spanDesc
+	for id, spans := range res.spans {
+		for i, s := range spans {
+			if id.Type == "work" && (first == nil || s.firstTimestamp() < first.firstTimestamp()) {
+				first = &spans[i]
+			}
+		}
+	}
+	if first == nil {
+		t.Fatal("no work span in the trace")
+	}
+
+	for _, tc := range []struct {
+		url  string
+		want int
+	}{
+		{"/spanblock?type=work", 3},
+		{"/spanblock?type=work&firstonly=1", 1},
+		{"/spanblock?firstonly=1", 2},
+	} {
+		filter, err := newSpanFilter(httptest.NewRequest("GET", tc.url, nil))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.url, err)
+		}
+		gToIntervals, err := pprofMatchingSpans(filter, true)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.url, err)
+		}
+		var got []interval
+		for _, intervals := range gToIntervals {
+			got = append(got, intervals...)
+		}
+		if len(got) != tc.want {
+			t.Errorf("%s: got %d spans; want %d", tc.url, len(got), tc.want)
+		}
+		if tc.want == 1 && got[0] != (interval{first.firstTimestamp(), first.lastTimestamp()}) {
+			t.Errorf("%s: got span %v; want the first work span", tc.url, got[0])
+		}
+	}
+	if _, err := newSpanFilter(httptest.NewRequest("GET", "/spanblock?firstonly=x", nil)); err == nil {
+		t.Errorf("invalid firstonly parameter accepted")
+	}
+}
+
+func TestSpanFilterErrors(t *testing.T) {
+	for _, tc := range []struct {
+		url, want string
+	}{
+		{"/spanblock?pc=xyz", `invalid pc parameter "xyz": want PC of the frame that started the span, in hexadecimal, as in /spanblock?pc=4a5b3c`},
+		{"/spanblock?latmin=10", `invalid latmin parameter "10": want minimum span duration, such as 10ms, as in /spanblock?latmin=10ms`},
+		{"/spanblock?latmax=-1s", `invalid latmax parameter "-1s"`},
+		{"/spanblock?latmin=1s&latmax=10ms", `invalid latmax parameter "10ms" (below latmin 1s)`},
+		{"/spanblock?name=(", `invalid name parameter "(" (error parsing regexp`},
+		{"/spanblock?firstonly=yes", `invalid firstonly parameter "yes": want 1 to keep only`},
+	} {
+		_, err := newSpanFilter(httptest.NewRequest("GET", tc.url, nil))
+		if _, ok := err.(*spanFilterError); !ok {
+			t.Errorf("%s: got error %v; want a spanFilterError", tc.url, err)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tc.want) {
+			t.Errorf("%s: got error %q; want prefix %q", tc.url, err, tc.want)
+		}
+	}
+
+	handler := serveSVGProfile(pprofBySpan(computePprofKind(profileBlock)))
+	for _, url := range []string{"/spanblock?pc=xyz", "/spanblock?pc=xyz&raw=1", "/spanblock?pc=xyz&format=text"} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", url, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d; want %d", url, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestTraceInfo(t *testing.T) {
+	if err := traceProgram(t, prog0, "TestTraceInfo"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	events, err := parseEvents()
+	if err != nil {
+		t.Fatalf("failed to parse events: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	httpTraceInfo(rec, httptest.NewRequest("GET", "/traceinfo", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	var info struct {
+		Events        int
+		EventsByType  map[string]int
+		Goroutines    int
+		DurationNanos int64
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("failed to decode trace info: %v", err)
+	}
+	if info.Events != len(events) {
+		t.Errorf("got %d events; want %d", info.Events, len(events))
+	}
+	n := 0
+	for _, c := range info.EventsByType {
+		n += c
+	}
+	if n != len(events) || info.EventsByType["UserSpan"] == 0 {
+		t.Errorf("got events by type %v; want %d events, including UserSpan", info.EventsByType, len(events))
+	}
+	if info.Goroutines == 0 || info.DurationNanos <= 0 {
+		t.Errorf("got %d goroutines over %dns; want some over a positive duration", info.Goroutines, info.DurationNanos)
+	}
+
+	defer func(err error) { loader.err = err }(loader.err)
+	loader.err = fmt.Errorf("corrupted trace")
+	rec = httptest.NewRecorder()
+	httpTraceInfo(rec, httptest.NewRequest("GET", "/traceinfo", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("with a parse error: got status %d; want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestNetBlockDirection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	if err := traceProgram(t, func() {
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			// Let the client block writing before reading everything.
+			time.Sleep(20 * time.Millisecond)
+			io.Copy(ioutil.Discard, c)
+		}()
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write(make([]byte, 32<<20)) // more than the socket buffers.
+		c.Close()
+		<-done
+	}, "TestNetBlockDirection"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	events, err := parseEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, ev := range events {
+		if ev.Type == traceparser.EvGoBlockNet {
+			got[netBlockDirection(ev.Stk)] = true
+		}
+	}
+	// The server blocks in Accept, waiting to read, and then in Read;
+	// the client blocks in Write.
+	if !got["read"] || !got["write"] {
+		t.Errorf("got network blocking directions %v; want read and write", got)
+	}
+}
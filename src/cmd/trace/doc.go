@@ -17,16 +17,54 @@ View the trace in a web browser:
 	go tool trace trace.out
 Generate a pprof-like profile from the trace:
 	go tool trace -pprof=TYPE trace.out > TYPE.pprof
+or, equivalently:
+	go tool trace -pprof=TYPE -o TYPE.pprof trace.out
+Render the profile as an svg graph, e.g. for reports:
+	go tool trace -pprof-svg=TYPE -o TYPE.svg trace.out
 
 Supported profile types are:
-	- net: network blocking profile
-	- sync: synchronization blocking profile
+	- io (or net): network blocking profile
+	- ioread, iowrite: network blocking profile, waiting to read or write
+	- dns: network blocking profile restricted to DNS resolution
+	- block (or sync): synchronization blocking profile
 	- syscall: syscall blocking profile
 	- sched: scheduler latency profile
+	- exec: goroutine execution profile
+	- gcassist: GC assist profile, by allocation site
+	- gcpause: GC pause profile
+	- wait: off-CPU wait profile, combining io, block, syscall and sched
+	- blocksched: synchronization blocking and scheduler latency profile
+	- idle: idle P profile, by the goroutine that last ran on the P
+	- lifetime: goroutine lifetime profile, by creation stack
 
 Then, you can use the pprof tool to analyze the profile:
 	go tool pprof TYPE.pprof
 
+Analyze several traces as one trace, e.g. to aggregate their profiles:
+	go tool trace trace1.out,trace2.out
+and compare the profiles of two of them, e.g. the block profiles,
+by visiting /diff?kind=block&a=trace1.out&b=trace2.out.
+
+The stacks of the goroutines running at an instant, such as
+during a latency spike, make up the profile at /running?at=TS,
+where TS is the instant in nanoseconds since the trace start.
+Likewise, the profiles are restricted to a time range with the start
+and end parameters, in nanoseconds since the trace start. These are
+the times shown by the trace viewer, in milliseconds there.
+
+The events of arbitrary types, such as custom events emitted by a
+patched runtime, make up the profile at /custom?types=T1,T2, where
+the types are numeric event types. The time from each event to the
+event it is linked to is accounted for at the event's stack.
+
+The goroutines and the time intervals a profile is restricted to by its
+query parameters are listed, as JSON, at /intervals or /spanintervals
+with the same parameters as the goroutine or span profile. This helps to
+tell why a profile is empty.
+
+The scale of the trace, such as its numbers of events and goroutines,
+and the time spent parsing it are reported as JSON at /traceinfo.
+
 Note that while the various profiles available when launching
 'go tool trace' work on every browser, the trace viewer itself
 (the 'view trace' page) comes from the Chrome/Chromium project
@@ -7,6 +7,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"internal/trace"
@@ -22,6 +23,7 @@ import (
 func init() {
 	http.HandleFunc("/goroutines", httpGoroutines)
 	http.HandleFunc("/goroutine", httpGoroutine)
+	http.HandleFunc("/goroutinetypes", httpGoroutineTypes)
 }
 
 // gtype describes a group of goroutines grouped by start PC.
@@ -38,10 +40,13 @@ var (
 )
 
 // analyzeGoroutines generates statistics about execution of all goroutines and stores them in gs.
-func analyzeGoroutines(events []*trace.Event) {
+// The analysis is done only once and the returned map is shared by concurrent requests,
+// so callers must use the returned map instead of gs and must not modify it.
+func analyzeGoroutines(events []*trace.Event) map[uint64]*trace.GDesc {
 	gsInit.Do(func() {
 		gs = trace.GoroutineStats(events)
 	})
+	return gs
 }
 
 // httpGoroutines serves list of goroutine groups.
@@ -51,9 +56,8 @@ func httpGoroutines(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	analyzeGoroutines(events)
 	gss := make(map[uint64]gtype)
-	for _, g := range gs {
+	for _, g := range analyzeGoroutines(events) {
 		gs1 := gss[g.PC]
 		gs1.ID = g.PC
 		gs1.Name = g.Name
@@ -85,6 +89,44 @@ Goroutines: <br>
 </html>
 `))
 
+// gtypeSummary summarizes the lifetime of a group of goroutines grouped by start PC.
+type gtypeSummary struct {
+	ID            uint64 `json:"id"`            // Unique identifier (PC), usable as the id parameter of profiles.
+	Name          string `json:"name"`          // Start function.
+	N             int    `json:"count"`         // Total number of goroutines in this group.
+	TotalLifetime int64  `json:"totalLifetime"` // Total lifetime of all goroutines in this group, in nanoseconds.
+	AvgLifetime   int64  `json:"avgLifetime"`   // Average lifetime of goroutines in this group, in nanoseconds.
+}
+
+// httpGoroutineTypes serves list of goroutine groups and their lifetime statistics as JSON.
+func httpGoroutineTypes(w http.ResponseWriter, r *http.Request) {
+	events, err := parseEvents()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	gss := make(map[uint64]gtypeSummary)
+	for _, g := range analyzeGoroutines(events) {
+		gs1 := gss[g.PC]
+		gs1.ID = g.PC
+		gs1.Name = g.Name
+		gs1.N++
+		gs1.TotalLifetime += g.TotalTime
+		gss[g.PC] = gs1
+	}
+	glist := make([]gtypeSummary, 0, len(gss))
+	for _, v := range gss {
+		v.AvgLifetime = v.TotalLifetime / int64(v.N)
+		glist = append(glist, v)
+	}
+	sort.Slice(glist, func(i, j int) bool { return glist[i].TotalLifetime > glist[j].TotalLifetime })
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(glist); err != nil {
+		log.Printf("failed to encode goroutine types: %v", err)
+		return
+	}
+}
+
 // httpGoroutine serves list of goroutines in a particular group.
 func httpGoroutine(w http.ResponseWriter, r *http.Request) {
 	// TODO(hyangah): support format=csv (raw data)
@@ -100,7 +142,6 @@ func httpGoroutine(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("failed to parse id parameter '%v': %v", r.FormValue("id"), err), http.StatusInternalServerError)
 		return
 	}
-	analyzeGoroutines(events)
 	var (
 		glist                   []*trace.GDesc
 		name                    string
@@ -108,7 +149,7 @@ func httpGoroutine(w http.ResponseWriter, r *http.Request) {
 		maxTotalTime            int64
 	)
 
-	for _, g := range gs {
+	for _, g := range analyzeGoroutines(events) {
 		totalExecTime += g.ExecTime
 
 		if g.PC != pc {
@@ -241,10 +282,10 @@ function reloadTable(key, value) {
 	<tr><td>Goroutine Name:</td><td>{{.Name}}</td></tr>
 	<tr><td>Number of Goroutines:</td><td>{{.N}}</td></tr>
 	<tr><td>Execution Time:</td><td>{{.ExecTimePercent}} of total program execution time </td> </tr>
-	<tr><td>Network Wait Time:</td><td> <a href="/io?id={{.PC}}">graph</a><a href="/io?id={{.PC}}&raw=1" download="io.profile">(download)</a></td></tr>
-	<tr><td>Sync Block Time:</td><td> <a href="/block?id={{.PC}}">graph</a><a href="/block?id={{.PC}}&raw=1" download="block.profile">(download)</a></td></tr>
-	<tr><td>Blocking Syscall Time:</td><td> <a href="/syscall?id={{.PC}}">graph</a><a href="/syscall?id={{.PC}}&raw=1" download="syscall.profile">(download)</a></td></tr>
-	<tr><td>Scheduler Wait Time:</td><td> <a href="/sched?id={{.PC}}">graph</a><a href="/sched?id={{.PC}}&raw=1" download="sched.profile">(download)</a></td></tr>
+	<tr><td>Network Wait Time:</td><td> <a href="/io?id={{.PC}}">graph</a><a href="/io?id={{.PC}}&raw=1" download="io.pb.gz">(download)</a></td></tr>
+	<tr><td>Sync Block Time:</td><td> <a href="/block?id={{.PC}}">graph</a><a href="/block?id={{.PC}}&raw=1" download="block.pb.gz">(download)</a></td></tr>
+	<tr><td>Blocking Syscall Time:</td><td> <a href="/syscall?id={{.PC}}">graph</a><a href="/syscall?id={{.PC}}&raw=1" download="syscall.pb.gz">(download)</a></td></tr>
+	<tr><td>Scheduler Wait Time:</td><td> <a href="/sched?id={{.PC}}">graph</a><a href="/sched?id={{.PC}}&raw=1" download="sched.pb.gz">(download)</a></td></tr>
 </table>
 <p>
 <table class="details">
@@ -6,19 +6,28 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"cmd/internal/browser"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
 	"internal/trace"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"runtime"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	_ "net/http/pprof" // Required to use pprof
 )
@@ -32,20 +41,43 @@ Open a web browser displaying trace:
 	go tool trace [flags] [pkg.test] trace.out
 
 Generate a pprof-like profile from the trace:
-    go tool trace -pprof=TYPE [pkg.test] trace.out
+    go tool trace -pprof=TYPE [-o profile.pb.gz] [pkg.test] trace.out
+
+Render it as an svg graph with go tool pprof:
+    go tool trace -pprof-svg=TYPE [-o profile.svg] [pkg.test] trace.out
 
 [pkg.test] argument is required for traces produced by Go 1.6 and below.
 Go 1.7 does not require the binary argument.
 
-Supported profile types are:
-    - net: network blocking profile
-    - sync: synchronization blocking profile
+The trace file may also be an HTTP URL to fetch it from, or '-' to read
+it from stdin.
+
+Several trace files separated by commas (e.g. trace1.out,trace2.out) may be given
+to analyze them as one trace in which each trace follows the previous one.
+Commas in the URLs of traces must be escaped as %2C.
+
+Supported profile types are the names of the profile pages:
+    - io (or net): network blocking profile
+    - ioread, iowrite: network blocking profile, waiting to read or write
+    - dns: network blocking profile restricted to DNS resolution
+    - block (or sync): synchronization blocking profile
     - syscall: syscall blocking profile
     - sched: scheduler latency profile
+    - exec: goroutine execution profile
+    - gcassist: GC assist profile, by allocation site
+    - gcpause: GC pause profile
+    - wait: off-CPU wait profile, combining io, block, syscall and sched
+    - blocksched: synchronization blocking and scheduler latency profile
+    - idle: idle P profile, by the goroutine that last ran on the P
+    - lifetime: goroutine lifetime profile, by creation stack
 
 Flags:
 	-http=addr: HTTP service address (e.g., ':6060')
 	-pprof=type: print a pprof-like profile instead
+	-pprof-svg=type: print a pprof-like profile rendered as svg instead
+	-o=file: write the pprof-like profile to file instead of stdout
+	-pprof-timeout=duration: time limit of go tool pprof rendering a profile (default 1m)
+	-pprof-bin=binary: render profiles with the pprof binary instead of go tool pprof (default $PPROF)
 	-d: print debug info such as parsed events
 
 Note that while the various profiles available when launching
@@ -57,8 +89,13 @@ and is only actively tested on that browser.
 var (
 	httpFlag  = flag.String("http", "localhost:0", "HTTP service address (e.g., ':6060')")
 	pprofFlag = flag.String("pprof", "", "print a pprof-like profile instead")
+	outFlag   = flag.String("o", "", "write the pprof-like profile to `file` instead of stdout")
 	debugFlag = flag.Bool("d", false, "print debug information such as parsed events list")
 
+	pprofSVGFlag     = flag.String("pprof-svg", "", "print a pprof-like profile rendered as svg instead")
+	pprofTimeoutFlag = flag.Duration("pprof-timeout", time.Minute, "time limit of go tool pprof rendering a profile")
+	pprofBinFlag     = flag.String("pprof-bin", os.Getenv("PPROF"), "render profiles with the pprof `binary` instead of go tool pprof")
+
 	// The binary file name, left here for serveSVGProfile.
 	programBinary string
 	traceFile     string
@@ -83,25 +120,34 @@ func main() {
 		flag.Usage()
 	}
 
-	var pprofFunc func(io.Writer, *http.Request) error
-	switch *pprofFlag {
-	case "net":
-		pprofFunc = pprofByGoroutine(computePprofIO)
-	case "sync":
-		pprofFunc = pprofByGoroutine(computePprofBlock)
-	case "syscall":
-		pprofFunc = pprofByGoroutine(computePprofSyscall)
-	case "sched":
-		pprofFunc = pprofByGoroutine(computePprofSched)
-	}
-	if pprofFunc != nil {
-		if err := pprofFunc(os.Stdout, &http.Request{}); err != nil {
+	if *pprofFlag != "" {
+		kind, ok := pprofFlagKind(*pprofFlag)
+		if !ok {
+			dief("unknown pprof type %s\n", *pprofFlag)
+		}
+		if err := writePprof(kind, *outFlag); err != nil {
 			dief("failed to generate pprof: %v\n", err)
 		}
 		os.Exit(0)
 	}
-	if *pprofFlag != "" {
-		dief("unknown pprof type %s\n", *pprofFlag)
+
+	if *pprofBinFlag != "" {
+		path, err := exec.LookPath(*pprofBinFlag)
+		if err != nil {
+			dief("invalid pprof binary: %v\n", err)
+		}
+		*pprofBinFlag = path
+	}
+
+	if *pprofSVGFlag != "" {
+		kind, ok := pprofFlagKind(*pprofSVGFlag)
+		if !ok {
+			dief("unknown pprof type %s\n", *pprofSVGFlag)
+		}
+		if err := writePprofSVG(kind, *outFlag); err != nil {
+			dief("failed to generate pprof svg: %v\n", err)
+		}
+		os.Exit(0)
 	}
 
 	ln, err := net.Listen("tcp", *httpFlag)
@@ -133,6 +179,7 @@ func main() {
 
 	// Start http server.
 	http.HandleFunc("/", httpMain)
+	http.HandleFunc("/traceinfo", httpTraceInfo)
 	err = http.Serve(ln, nil)
 	dief("failed to start http server: %v\n", err)
 }
@@ -143,6 +190,12 @@ var loader struct {
 	once sync.Once
 	res  trace.ParseResult
 	err  error
+
+	// The individual traces merged into res, and their file names.
+	traces []trace.ParseResult
+	names  []string
+
+	parseTime time.Duration // time spent reading and parsing the traces.
 }
 
 // parseEvents is a compatibility wrapper that returns only
@@ -157,22 +210,154 @@ func parseEvents() ([]*trace.Event, error) {
 
 func parseTrace() (trace.ParseResult, error) {
 	loader.once.Do(func() {
-		tracef, err := os.Open(traceFile)
-		if err != nil {
-			loader.err = fmt.Errorf("failed to open trace file: %v", err)
-			return
+		start := time.Now()
+		defer func() { loader.parseTime = time.Since(start) }()
+		names := traceFileNames()
+		var results []trace.ParseResult
+		for _, name := range names {
+			res, err := parseTraceFile(name)
+			if err != nil {
+				loader.err = err
+				return
+			}
+			results = append(results, res)
 		}
-		defer tracef.Close()
+		loader.res = mergeTraces(results)
+		loader.traces = results
+		loader.names = names
+	})
+	return loader.res, loader.err
+}
+
+// traceFileSeparator separates the trace files given on the command line.
+// The HTTP URLs of traces must escape it, as %2C.
+const traceFileSeparator = ","
 
-		// Parse and symbolize.
-		res, err := trace.Parse(bufio.NewReader(tracef), programBinary)
+// traceFileNames returns the names of the trace files given on the command line.
+func traceFileNames() []string {
+	return strings.Split(traceFile, traceFileSeparator)
+}
+
+// traceEnd returns the end of the trace that the timestamp ts belongs to,
+// that is the timestamp of its last event, so that the events left
+// unfinished at the end of one of several merged traces do not last
+// over the following traces.
+func traceEnd(ts int64) int64 {
+	parseTrace() // loads loader.traces.
+	if len(loader.traces) > 1 {
+		for _, res := range loader.traces {
+			if n := len(res.Events); n > 0 && ts <= res.Events[n-1].Ts {
+				return res.Events[n-1].Ts
+			}
+		}
+	}
+	return lastTimestamp()
+}
+
+// traceByRef returns one of the traces given on the command line,
+// referenced by ref as either the trace file name or its index.
+// The events of the returned trace are part of the merged trace.
+func traceByRef(ref string) (trace.ParseResult, error) {
+	if _, err := parseTrace(); err != nil {
+		return trace.ParseResult{}, err
+	}
+	for i, name := range loader.names {
+		if name == ref {
+			return loader.traces[i], nil
+		}
+	}
+	if i, err := strconv.Atoi(ref); err == nil && 0 <= i && i < len(loader.traces) {
+		return loader.traces[i], nil
+	}
+	return trace.ParseResult{}, &paramError{fmt.Errorf("unknown trace %q: want one of %s, or its index", ref, strings.Join(loader.names, ", "))}
+}
+
+// parseTraceFile parses and symbolizes the named trace file.
+func parseTraceFile(name string) (trace.ParseResult, error) {
+	tracef, err := openTrace(name)
+	if err != nil {
+		return trace.ParseResult{}, fmt.Errorf("failed to open trace file: %v", err)
+	}
+	defer tracef.Close()
+
+	// Traces compressed with gzip, as trace.out.gz, are
+	// recognized by their magic number and decompressed.
+	br := bufio.NewReader(tracef)
+	var r io.Reader = br
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
 		if err != nil {
-			loader.err = fmt.Errorf("failed to parse trace: %v", err)
-			return
+			return trace.ParseResult{}, fmt.Errorf("failed to decompress trace: %v", err)
 		}
-		loader.res = res
-	})
-	return loader.res, loader.err
+		defer zr.Close()
+		r = bufio.NewReader(zr)
+	}
+
+	// Parse and symbolize.
+	res, err := trace.Parse(r, programBinary)
+	if err != nil {
+		return trace.ParseResult{}, fmt.Errorf("failed to parse trace: %v", err)
+	}
+	return res, nil
+}
+
+// gzipMagic starts the files compressed with gzip.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// mergeTraces concatenates the parsed traces into one trace, modifying
+// their events in place. The timestamps of each trace are shifted so that
+// the trace follows the previous one, and the goroutine, stack and task ids
+// are offset so that the ids from different traces do not collide.
+func mergeTraces(results []trace.ParseResult) trace.ParseResult {
+	if len(results) == 1 {
+		return results[0]
+	}
+	merged := trace.ParseResult{Stacks: make(map[uint64][]*trace.Frame)}
+	var tsOff int64
+	var gOff, stkOff, taskOff uint64
+	for _, res := range results {
+		var maxG, maxStk, maxTask uint64
+		// offset returns id offset by off, recording the maximum id seen.
+		// Id 0 means no goroutine, stack or task, and is left as is.
+		offset := func(id, off uint64, max *uint64) uint64 {
+			if id == 0 {
+				return 0
+			}
+			if *max < id {
+				*max = id
+			}
+			return id + off
+		}
+		for id, stk := range res.Stacks {
+			merged.Stacks[offset(id, stkOff, &maxStk)] = stk
+		}
+		for _, ev := range res.Events {
+			ev.Ts += tsOff
+			ev.G = offset(ev.G, gOff, &maxG)
+			ev.StkID = offset(ev.StkID, stkOff, &maxStk)
+			switch ev.Type {
+			case trace.EvGoCreate: // [new goroutine id, new stack id]
+				ev.Args[0] = offset(ev.Args[0], gOff, &maxG)
+				ev.Args[1] = offset(ev.Args[1], stkOff, &maxStk)
+			case trace.EvGoStart, trace.EvGoStartLabel, trace.EvGoUnblock,
+				trace.EvGoSysExit, trace.EvGoWaiting, trace.EvGoInSyscall: // [goroutine id]
+				ev.Args[0] = offset(ev.Args[0], gOff, &maxG)
+			case trace.EvUserTaskCreate: // [task id, parent task id]
+				ev.Args[0] = offset(ev.Args[0], taskOff, &maxTask)
+				ev.Args[1] = offset(ev.Args[1], taskOff, &maxTask)
+			case trace.EvUserTaskEnd, trace.EvUserSpan, trace.EvUserLog: // [task id]
+				ev.Args[0] = offset(ev.Args[0], taskOff, &maxTask)
+			}
+		}
+		merged.Events = append(merged.Events, res.Events...)
+		if n := len(res.Events); n > 0 {
+			tsOff = res.Events[n-1].Ts + 1
+		}
+		gOff += maxG
+		stkOff += maxStk
+		taskOff += maxTask
+	}
+	return merged
 }
 
 // httpMain serves the starting page.
@@ -183,6 +368,40 @@ func httpMain(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// httpTraceInfo serves, as JSON, the scale of the trace: its numbers of
+// events, by type, and of goroutines, its duration and the time spent
+// parsing it. It fails if the trace could not be parsed.
+func httpTraceInfo(w http.ResponseWriter, r *http.Request) {
+	events, err := parseEvents()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	byType := make(map[string]int)
+	for _, ev := range events {
+		byType[trace.EventDescriptions[ev.Type].Name]++
+	}
+	info := struct {
+		Traces        []string       `json:"traces"`
+		Events        int            `json:"events"`
+		EventsByType  map[string]int `json:"eventsByType"`
+		Goroutines    int            `json:"goroutines"`
+		DurationNanos int64          `json:"durationNanos"` // from the first to the last event.
+		ParseNanos    int64          `json:"parseNanos"`
+	}{
+		Traces:        loader.names,
+		Events:        len(events),
+		EventsByType:  byType,
+		Goroutines:    len(analyzeGoroutines(events)),
+		DurationNanos: lastTimestamp() - firstTimestamp(),
+		ParseNanos:    loader.parseTime.Nanoseconds(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		log.Printf("failed to encode trace info: %v", err)
+	}
+}
+
 var templMain = template.Must(template.New("").Parse(`
 <html>
 <body>
@@ -195,16 +414,124 @@ var templMain = template.Must(template.New("").Parse(`
 	<a href="/trace">View trace</a><br>
 {{end}}
 <a href="/goroutines">Goroutine analysis</a><br>
-<a href="/io">Network blocking profile</a> (<a href="/io?raw=1" download="io.profile">⬇</a>)<br>
-<a href="/block">Synchronization blocking profile</a> (<a href="/block?raw=1" download="block.profile">⬇</a>)<br>
-<a href="/syscall">Syscall blocking profile</a> (<a href="/syscall?raw=1" download="syscall.profile">⬇</a>)<br>
-<a href="/sched">Scheduler latency profile</a> (<a href="/sche?raw=1" download="sched.profile">⬇</a>)<br>
+<a href="/io">Network blocking profile</a> (<a href="/io?raw=1" download="io.pb.gz">⬇</a>)<br>
+<a href="/dns">DNS resolution blocking profile</a> (<a href="/dns?raw=1" download="dns.pb.gz">⬇</a>)<br>
+<a href="/block">Synchronization blocking profile</a> (<a href="/block?raw=1" download="block.pb.gz">⬇</a>)
+	by reason: <a href="/block?reason=send">send</a>, <a href="/block?reason=recv">recv</a>, <a href="/block?reason=select">select</a>, <a href="/block?reason=sync">sync</a>, <a href="/block?reason=cond">cond</a><br>
+<a href="/syscall">Syscall blocking profile</a> (<a href="/syscall?raw=1" download="syscall.pb.gz">⬇</a>)<br>
+<a href="/sched">Scheduler latency profile</a> (<a href="/sched?raw=1" download="sched.pb.gz">⬇</a>)<br>
+<a href="/profiles.zip" download="profiles.zip">Network, synchronization, syscall and scheduler latency profiles</a> (zip)<br>
+<a href="/exec">Goroutine execution profile</a> (<a href="/exec?raw=1" download="exec.pb.gz">⬇</a>)<br>
+<a href="/gcassist">GC assist profile</a> (<a href="/gcassist?raw=1" download="gcassist.pb.gz">⬇</a>)<br>
+<a href="/gcpause">GC pause profile</a> (<a href="/gcpause?raw=1" download="gcpause.pb.gz">⬇</a>)<br>
+<a href="/wait">Off-CPU wait profile</a> (<a href="/wait?raw=1" download="wait.pb.gz">⬇</a>)<br>
+<a href="/blocksched">Synchronization blocking and scheduler latency profile</a> (<a href="/blocksched?raw=1" download="blocksched.pb.gz">⬇</a>)<br>
+<a href="/idle">Idle P profile</a> (<a href="/idle?raw=1" download="idle.pb.gz">⬇</a>)<br>
+<a href="/lifetime">Goroutine lifetime profile</a> (<a href="/lifetime?raw=1" download="lifetime.pb.gz">⬇</a>)<br>
+<a href="/goroutinecount">Goroutine creation profile</a> (<a href="/goroutinecount?raw=1" download="goroutinecount.pb.gz">⬇</a>)<br>
 <a href="/usertasks">User-defined tasks</a><br>
 <a href="/userspans">User-defined spans</a><br>
 </body>
 </html>
 `))
 
+// pprofFlagAliases maps the former names of the -pprof flag values,
+// which differ from the profile page names, to the profile kinds.
+var pprofFlagAliases = map[string]profileKind{
+	"net":  profileIO,
+	"sync": profileBlock,
+}
+
+// pprofFlagKind returns the profile kind named by the value of the -pprof
+// or -pprof-svg flag.
+func pprofFlagKind(name string) (profileKind, bool) {
+	if k := profileKinds[name]; k != nil {
+		return k.kind, true
+	}
+	kind, ok := pprofFlagAliases[name]
+	return kind, ok
+}
+
+// writePprof writes the pprof-like profile of the given kind, computed
+// over the whole trace, to the named file, or to stdout if name is empty.
+func writePprof(kind profileKind, name string) error {
+	events, err := parseEvents()
+	if err != nil {
+		return err
+	}
+	p, err := computeProfile(kind, events, nil, nil)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return p.Write(os.Stdout)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := p.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writePprofSVG is like writePprof but writes the profile rendered as svg
+// by pprof, which is given the time set by the -pprof-timeout flag.
+func writePprofSVG(kind profileKind, name string) error {
+	events, err := parseEvents()
+	if err != nil {
+		return err
+	}
+	p, err := computeProfile(kind, events, nil, nil)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *pprofTimeoutFlag)
+	defer cancel()
+	svg, err := renderSVG(ctx, buf.Bytes(), nil)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("pprof did not finish within %v", *pprofTimeoutFlag)
+		}
+		return err
+	}
+	if name == "" {
+		_, err := os.Stdout.Write(svg)
+		return err
+	}
+	return ioutil.WriteFile(name, svg, 0666)
+}
+
+// traceFetchTimeout is the time limit for fetching a trace over HTTP.
+const traceFetchTimeout = 5 * time.Minute
+
+// openTrace opens the named trace, which is read from
+// stdin if name is "-", or fetched if name is an HTTP URL.
+func openTrace(name string) (io.ReadCloser, error) {
+	switch {
+	case name == "-":
+		return ioutil.NopCloser(os.Stdin), nil
+	case strings.HasPrefix(name, "http://"), strings.HasPrefix(name, "https://"):
+		client := &http.Client{Timeout: traceFetchTimeout}
+		resp, err := client.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to fetch %s: %s", name, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(name)
+}
+
 func dief(msg string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, msg, args...)
 	os.Exit(1)
@@ -7,24 +7,42 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"cmd/internal/buildid"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"internal/trace"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/google/pprof/profile"
 )
 
-func goCmd() string {
+// goCmd returns the go command used to run go tool pprof.
+// It is a variable so that tests can substitute a failing command.
+var goCmd = func() string {
 	var exeSuffix string
 	if runtime.GOOS == "windows" {
 		exeSuffix = ".exe"
@@ -37,95 +55,873 @@ func goCmd() string {
 }
 
 func init() {
-	http.HandleFunc("/io", serveSVGProfile(pprofByGoroutine(computePprofIO)))
-	http.HandleFunc("/block", serveSVGProfile(pprofByGoroutine(computePprofBlock)))
-	http.HandleFunc("/syscall", serveSVGProfile(pprofByGoroutine(computePprofSyscall)))
-	http.HandleFunc("/sched", serveSVGProfile(pprofByGoroutine(computePprofSched)))
+	for name, k := range profileKinds {
+		http.HandleFunc("/"+name, serveSVGProfile(pprofByGoroutine(computePprofKind(k.kind))))
+		http.HandleFunc("/span"+name, serveSVGProfile(pprofBySpan(computePprofKind(k.kind))))
+	}
 
-	http.HandleFunc("/spanio", serveSVGProfile(pprofBySpan(computePprofIO)))
-	http.HandleFunc("/spanblock", serveSVGProfile(pprofBySpan(computePprofBlock)))
-	http.HandleFunc("/spansyscall", serveSVGProfile(pprofBySpan(computePprofSyscall)))
-	http.HandleFunc("/spansched", serveSVGProfile(pprofBySpan(computePprofSched)))
+	http.HandleFunc("/diff", serveSVGProfile(pprofDiff))
+	http.HandleFunc("/goroutinecount", serveSVGProfile(pprofGoroutineCount))
+	http.HandleFunc("/running", serveSVGProfile(pprofRunning))
+	http.HandleFunc("/custom", serveSVGProfile(pprofCustom))
+	http.HandleFunc("/profiles.zip", serveProfilesZip)
+	http.HandleFunc("/intervals", serveIntervals(pprofByGoroutine(writeIntervals)))
+	http.HandleFunc("/spanintervals", serveIntervals(pprofBySpan(writeIntervals)))
 }
 
 // Record represents one entry in pprof-like profiles.
 type Record struct {
+	// stk shares its frames with the stacks of the parsed trace, so
+	// holding it costs a slice header per record. It is kept rather than
+	// looked up by the stack id in the key, as that id is not a trace
+	// stack id for the synthetic stacks, such as with by=goroutine, and
+	// the records of a diff come from different traces.
 	stk  []*trace.Frame
-	n    uint64
+	n    int64
 	time int64
 }
 
+// recordKey identifies a Record in pprof-like profiles. Records are keyed
+// by the stack, and also by the goroutine and P only if labels are kept,
+// and by the time bucket only if the trace is split into buckets.
+type recordKey struct {
+	stkID  uint64
+	g      uint64
+	p      int
+	bucket int
+	reason string // reason of the wait, kept as a label; see pprofCombinedRecords and pprofSchedRecords.
+	labels string // other labels, as "key=value" lines; see pprofSchedRecords.
+}
+
+// less orders the record keys, so that profiles are built deterministically.
+func (k recordKey) less(o recordKey) bool {
+	switch {
+	case k.stkID != o.stkID:
+		return k.stkID < o.stkID
+	case k.reason != o.reason:
+		return k.reason < o.reason
+	case k.labels != o.labels:
+		return k.labels < o.labels
+	case k.g != o.g:
+		return k.g < o.g
+	case k.p != o.p:
+		return k.p < o.p
+	}
+	return k.bucket < o.bucket
+}
+
+// pprofRecords accumulates the Records of a pprof-like profile.
+type pprofRecords struct {
+	opts *pprofOptions
+	recs map[recordKey]Record
+	kind string // kind of the profile, recorded in the profile comments.
+
+	// reasonLabel is the name of the label holding the reasons
+	// of the records, if not "reason".
+	reasonLabel string
+
+	// durations holds the durations of the accounted events,
+	// only if the summary option is set.
+	durations []time.Duration
+
+	// dropped is the number of events that could not be accounted
+	// because the trace has no stack for them, and droppedTime their
+	// total duration in nanoseconds.
+	dropped     int64
+	droppedTime int64
+
+	// skewed is the number of events that end before they start,
+	// due to clock skew between Ps, and are not accounted.
+	skewed int64
+}
+
+// waitingGoroutine returns the id of the goroutine that waits during the
+// event ev. That is the goroutine of the event, except for the events that
+// make another goroutine runnable, as in the scheduler latency profile.
+func waitingGoroutine(ev *trace.Event) uint64 {
+	switch ev.Type {
+	case trace.EvGoCreate, trace.EvGoUnblock:
+		return ev.Args[0]
+	}
+	return ev.G
+}
+
+func newPprofRecords(opts *pprofOptions) *pprofRecords {
+	if opts == nil {
+		opts = &pprofOptions{}
+	}
+	return &pprofRecords{opts: opts, recs: make(map[recordKey]Record)}
+}
+
+// merge adds the records of part to prof.
+func (prof *pprofRecords) merge(part *pprofRecords) {
+	for key, rec := range part.recs {
+		r := prof.recs[key]
+		r.stk = rec.stk
+		r.n += rec.n
+		r.time += rec.time
+		prof.recs[key] = r
+	}
+	prof.durations = append(prof.durations, part.durations...)
+	prof.dropped += part.dropped
+	prof.droppedTime += part.droppedTime
+	prof.skewed += part.skewed
+}
+
+// cancelCheckInterval is the number of events between
+// checks for the cancellation of the profile request.
+const cancelCheckInterval = 1 << 14
+
+// checkCanceled returns the error of the request context if the request
+// was canceled. It only checks every cancelCheckInterval events, given
+// the index i of the current event, to keep the scan of events cheap.
+func (prof *pprofRecords) checkCanceled(i int) error {
+	if i%cancelCheckInterval != 0 || prof.opts.ctx == nil {
+		return nil
+	}
+	return prof.opts.ctx.Err()
+}
+
+// add accounts the duration d of the event ev to the record of the stack stk.
+// Events whose duration, after restriction to the filter intervals,
+// is shorter than the minimum duration option are dropped.
+func (prof *pprofRecords) add(ev *trace.Event, stkID uint64, stk []*trace.Frame, d time.Duration) {
+	prof.addReason(ev, stkID, stk, d, "")
+}
+
+// addReason is like add but accounts the duration to the record
+// of the stack stk for the given reason. Events without a stack are
+// not accounted, but counted as dropped.
+func (prof *pprofRecords) addReason(ev *trace.Event, stkID uint64, stk []*trace.Frame, d time.Duration, reason string) {
+	prof.addLabels(ev, stkID, stk, d, reason, "")
+}
+
+// addLabels is like addReason but also keeps the given labels, as
+// "key=value" lines, such as with the waker option of the scheduler
+// latency profile.
+func (prof *pprofRecords) addLabels(ev *trace.Event, stkID uint64, stk []*trace.Frame, d time.Duration, reason, labels string) {
+	if d < prof.opts.minDuration {
+		return
+	}
+	if stkID == 0 || len(stk) == 0 {
+		prof.dropped++
+		prof.droppedTime += d.Nanoseconds()
+		return
+	}
+	if prof.opts.summary {
+		prof.durations = append(prof.durations, d)
+	}
+	switch prof.opts.by {
+	case "goroutine":
+		g := waitingGoroutine(ev)
+		stkID, stk = g, []*trace.Frame{{PC: g, Fn: fmt.Sprintf("goroutine %d", g)}}
+	case "type":
+		stkID, stk = 0, []*trace.Frame{{Fn: "unknown goroutine type"}}
+		if g := prof.opts.goroutines[waitingGoroutine(ev)]; g != nil {
+			stkID, stk = g.PC, []*trace.Frame{{PC: g.PC, Fn: g.Name}}
+		}
+	case "unblocker":
+		// The stack of the goroutine that ended the wait, such as the
+		// unlock of the mutex the goroutine was blocked on, to point at
+		// the cause of the contention. Events ended without a stack,
+		// such as by the network poller, keep their own stack.
+		if l := ev.Link; l != nil && l.Type == trace.EvGoUnblock && l.StkID != 0 && len(l.Stk) > 0 {
+			stkID, stk = l.StkID, l.Stk
+		}
+	}
+	key := recordKey{stkID: stkID, reason: reason, labels: labels}
+	if prof.opts.byLabel {
+		key.g, key.p = waitingGoroutine(ev), ev.P
+	}
+	if prof.opts.buckets > 0 {
+		key.bucket = timeBucket(ev.Ts, firstTimestamp(), lastTimestamp(), prof.opts.buckets)
+	}
+	rec := prof.recs[key]
+	rec.stk = stk
+	rec.n++
+	rec.time += d.Nanoseconds()
+	prof.recs[key] = rec
+}
+
+// timeBucket returns the index of the bucket holding the timestamp ts
+// when the time from first to last is split into n buckets of equal length.
+func timeBucket(ts, first, last int64, n int) int {
+	if last <= first {
+		return 0
+	}
+	b := int((ts - first) * int64(n) / (last - first))
+	if b < 0 {
+		return 0
+	}
+	if b >= n {
+		return n - 1
+	}
+	return b
+}
+
+// pprofOptions holds the request parameters that control
+// how pprof-like profiles are aggregated and built.
+type pprofOptions struct {
+	ctx         context.Context // context of the request; nil means never canceled.
+	byLabel     bool            // aggregate per goroutine and P, and keep them as labels.
+	blockTypes  map[byte]bool   // blocking event types in the block profile; nil means all.
+	minDuration time.Duration   // events shorter than this are not accounted.
+	unit        delayUnit       // unit of the delay values; the zero value means nanoseconds.
+	hide        *regexp.Regexp  // frames of matching functions are removed from stacks.
+	collapse    bool            // recursive calls are collapsed into a single frame.
+	maxDepth    int             // stacks are truncated to this many innermost frames; 0 means unlimited.
+	summary     bool            // the percentiles of the event durations are added to the comments.
+	by          string          // "goroutine", "type" or "unblocker" to aggregate by those instead of stack.
+	mergeByFunc bool            // locations are identified by their source lines instead of PC.
+	avg         bool            // samples have a third value, the average delay per event.
+
+	// goroutines are the goroutines of the trace by id, to aggregate by
+	// their type, as set by setGoroutines once the trace is parsed.
+	goroutines map[uint64]*trace.GDesc
+
+	// buckets, if positive, is the number of buckets of equal length
+	// the trace is split into. Samples are labeled with the timebucket
+	// of the start of their events, so that the profile can be sliced
+	// in time, as with pprof -tagfocus=timebucket=3.
+	buckets int
+
+	// nested keeps nested spans in span profiles, so that each span
+	// contributes its own intervals. The time in a nested span is then
+	// counted once for each matching span enclosing it, including itself.
+	nested bool
+
+	// blockedOnly restricts the syscall profile to the time syscalls
+	// blocked, from EvGoSysBlock, when the P was handed off, to the exit.
+	blockedOnly bool
+
+	// waker labels the samples of the scheduler latency profile with
+	// the waker of the goroutines, and keeps those made runnable
+	// without a stack, such as by the network poller; see schedWaker.
+	waker bool
+
+	// idleP labels the samples of the scheduler latency profile with
+	// whether a P was idle while the goroutines waited to run, that is,
+	// whether the wait was due to a missed wakeup rather than to
+	// all Ps being busy.
+	idleP bool
+
+	// weightBytes weights the samples of the network blocking profiles
+	// by the bytes transferred rather than by the time blocked, which
+	// no trace supports yet; see bytesWeightError.
+	weightBytes bool
+}
+
+// delayUnit is a unit of the delay values of profiles.
+type delayUnit struct {
+	name string // as in profile.ValueType.
+	d    time.Duration
+}
+
+// delayUnits maps the values of the unit request parameter to the units.
+var delayUnits = map[string]delayUnit{
+	"ns": {"nanoseconds", time.Nanosecond},
+	"us": {"microseconds", time.Microsecond},
+	"ms": {"milliseconds", time.Millisecond},
+}
+
+// blockReasons maps the values of the reason request parameter
+// to the corresponding synchronization blocking event types.
+var blockReasons = map[string]byte{
+	"send":   trace.EvGoBlockSend,
+	"recv":   trace.EvGoBlockRecv,
+	"select": trace.EvGoBlockSelect,
+	"sync":   trace.EvGoBlockSync,
+	"cond":   trace.EvGoBlockCond,
+}
+
+// newPprofOptions parses the profile options from the request parameters.
+func newPprofOptions(r *http.Request) (*pprofOptions, error) {
+	opts := &pprofOptions{ctx: r.Context()}
+	switch v := r.FormValue("bylabel"); v {
+	case "", "0":
+	case "1":
+		opts.byLabel = true
+	default:
+		return nil, fmt.Errorf("invalid bylabel parameter: %v", v)
+	}
+	switch v := r.FormValue("by"); v {
+	case "", "stack":
+	case "goroutine", "type", "unblocker":
+		opts.by = v
+	default:
+		return nil, fmt.Errorf("invalid by parameter: %v (want stack, goroutine, type or unblocker)", v)
+	}
+	switch v := r.FormValue("mergeby"); v {
+	case "", "pc":
+	case "func":
+		opts.mergeByFunc = true
+	default:
+		return nil, fmt.Errorf("invalid mergeby parameter: %v (want pc or func)", v)
+	}
+	switch v := r.FormValue("avg"); v {
+	case "", "0":
+	case "1":
+		opts.avg = true
+	default:
+		return nil, fmt.Errorf("invalid avg parameter: %v", v)
+	}
+	switch v := r.FormValue("summary"); v {
+	case "", "0":
+	case "1":
+		opts.summary = true
+	default:
+		return nil, fmt.Errorf("invalid summary parameter: %v", v)
+	}
+	switch v := r.FormValue("collapse"); v {
+	case "", "0":
+	case "1":
+		opts.collapse = true
+	default:
+		return nil, fmt.Errorf("invalid collapse parameter: %v", v)
+	}
+	switch v := r.FormValue("nested"); v {
+	case "", "0":
+	case "1":
+		opts.nested = true
+	default:
+		return nil, fmt.Errorf("invalid nested parameter: %v", v)
+	}
+	switch v := r.FormValue("blockedonly"); v {
+	case "", "0":
+	case "1":
+		opts.blockedOnly = true
+	default:
+		return nil, fmt.Errorf("invalid blockedonly parameter: %v", v)
+	}
+	switch v := r.FormValue("waker"); v {
+	case "", "0":
+	case "1":
+		opts.waker = true
+	default:
+		return nil, fmt.Errorf("invalid waker parameter: %v", v)
+	}
+	switch v := r.FormValue("weight"); v {
+	case "", "time":
+	case "bytes":
+		opts.weightBytes = true
+	default:
+		return nil, fmt.Errorf("invalid weight parameter: %v (want time or bytes)", v)
+	}
+	switch v := r.FormValue("idlep"); v {
+	case "", "0":
+	case "1":
+		opts.idleP = true
+	default:
+		return nil, fmt.Errorf("invalid idlep parameter: %v", v)
+	}
+	if v := r.FormValue("unit"); v != "" {
+		unit, ok := delayUnits[v]
+		if !ok {
+			return nil, fmt.Errorf("invalid unit parameter: %v (want ms, us or ns)", v)
+		}
+		opts.unit = unit
+	}
+	if v := r.FormValue("buckets"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid buckets parameter: %v", v)
+		}
+		opts.buckets = n
+	}
+	if v := r.FormValue("maxdepth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid maxdepth parameter: %v", v)
+		}
+		opts.maxDepth = n
+	}
+	if v := r.FormValue("min"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid min parameter: %v", v)
+		}
+		opts.minDuration = d
+	}
+	var hide []string
+	switch v := r.FormValue("hideruntime"); v {
+	case "", "0":
+	case "1":
+		hide = append(hide, `^runtime\.`)
+	default:
+		return nil, fmt.Errorf("invalid hideruntime parameter: %v", v)
+	}
+	if v := r.FormValue("hide"); v != "" {
+		if _, err := regexp.Compile(v); err != nil {
+			return nil, fmt.Errorf("invalid hide parameter: %v", err)
+		}
+		hide = append(hide, v)
+	}
+	if len(hide) > 0 {
+		opts.hide = regexp.MustCompile("(?:" + strings.Join(hide, ")|(?:") + ")")
+	}
+	if v := r.FormValue("reason"); v != "" {
+		opts.blockTypes = make(map[byte]bool)
+		for _, reason := range strings.Split(v, ",") {
+			typ, ok := blockReasons[reason]
+			if !ok {
+				return nil, fmt.Errorf("invalid reason parameter: %v (want send, recv, select, sync or cond)", reason)
+			}
+			opts.blockTypes[typ] = true
+		}
+	}
+	return opts, nil
+}
+
+// setGoroutines sets the goroutines analyzed from events, the events of the
+// loaded trace, if the options aggregate by goroutine type.
+func (opts *pprofOptions) setGoroutines(events []*trace.Event) {
+	if opts.by == "type" {
+		opts.goroutines = analyzeGoroutines(events)
+	}
+}
+
 // interval represents a time interval in the trace.
 type interval struct {
 	begin, end int64 // nanoseconds.
 }
 
-func pprofByGoroutine(compute func(io.Writer, map[uint64][]interval, []*trace.Event) error) func(w io.Writer, r *http.Request) error {
+func pprofByGoroutine(compute func(io.Writer, map[uint64][]interval, []*trace.Event, *pprofOptions) error) func(w io.Writer, r *http.Request) error {
 	return func(w io.Writer, r *http.Request) error {
+		opts, err := newPprofOptions(r)
+		if err != nil {
+			return &paramError{err}
+		}
 		id := r.FormValue("id")
 		events, err := parseEvents()
 		if err != nil {
 			return err
 		}
+		opts.setGoroutines(events)
 		gToIntervals, err := pprofMatchingGoroutines(id, events)
 		if err != nil {
 			return err
 		}
-		return compute(w, gToIntervals, events)
+		gToIntervals, err = pprofMatchingGoroutineIDs(r, gToIntervals, events)
+		if err != nil {
+			return err
+		}
+		gToIntervals, err = pprofCreatedAfter(r, gToIntervals, events)
+		if err != nil {
+			return err
+		}
+		gToIntervals, err = pprofMatchingGoroutineNames(r, gToIntervals, events)
+		if err != nil {
+			return err
+		}
+		gToIntervals, err = pprofMatchingGoroutineSpans(r, gToIntervals, opts.nested)
+		if err != nil {
+			return err
+		}
+		gToIntervals, err = pprofMatchingTask(r, gToIntervals)
+		if err != nil {
+			return err
+		}
+		gToIntervals, err = pprofRestrictTimeRange(r, gToIntervals, events)
+		if err != nil {
+			return err
+		}
+		events, err = pprofFilterProcs(r, events)
+		if err != nil {
+			return err
+		}
+		return compute(w, gToIntervals, events, opts)
 	}
 }
 
-func pprofBySpan(compute func(io.Writer, map[uint64][]interval, []*trace.Event) error) func(w io.Writer, r *http.Request) error {
+func pprofBySpan(compute func(io.Writer, map[uint64][]interval, []*trace.Event, *pprofOptions) error) func(w io.Writer, r *http.Request) error {
 	return func(w io.Writer, r *http.Request) error {
+		opts, err := newPprofOptions(r)
+		if err != nil {
+			return &paramError{err}
+		}
 		filter, err := newSpanFilter(r)
 		if err != nil {
 			return err
 		}
-		gToIntervals, err := pprofMatchingSpans(filter)
+		gToIntervals, err := pprofMatchingSpans(filter, opts.nested)
 		if err != nil {
 			return err
 		}
-		events, _ := parseEvents()
-
-		return compute(w, gToIntervals, events)
+		events, err := parseEvents()
+		if err != nil {
+			return err
+		}
+		opts.setGoroutines(events)
+		return compute(w, gToIntervals, events, opts)
 	}
 }
 
-// pprofMatchingGoroutines parses the goroutine type id string (i.e. pc)
-// and returns the ids of goroutines of the matching type and its interval.
+// pprofMatchingGoroutines parses the goroutine type id string (i.e. pc),
+// or a comma-separated list of them, and returns the ids of goroutines of
+// the matching types and their intervals.
 // If the id string is empty, returns nil without an error.
 func pprofMatchingGoroutines(id string, events []*trace.Event) (map[uint64][]interval, error) {
 	if id == "" {
 		return nil, nil
 	}
-	pc, err := strconv.ParseUint(id, 10, 64) // id is string
-	if err != nil {
-		return nil, fmt.Errorf("invalid goroutine type: %v", id)
+	pcs := make(map[uint64]bool)
+	var firstPC uint64 // to suggest the closest goroutine types.
+	for i, s := range strings.Split(id, ",") {
+		pc, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64) // id is string
+		if err != nil {
+			return nil, fmt.Errorf("invalid goroutine type: %v", s)
+		}
+		if i == 0 {
+			firstPC = pc
+		}
+		pcs[pc] = true
 	}
-	analyzeGoroutines(events)
 	var res map[uint64][]interval
+	gs := analyzeGoroutines(events)
 	for _, g := range gs {
-		if g.PC != pc {
+		if !pcs[g.PC] {
 			continue
 		}
 		if res == nil {
 			res = make(map[uint64][]interval)
 		}
-		endTime := g.EndTime
-		if g.EndTime == 0 {
-			endTime = lastTimestamp() // the trace doesn't include the goroutine end event. Use the trace end time.
-		}
-		res[g.ID] = []interval{{begin: g.StartTime, end: endTime}}
+		res[g.ID] = []interval{goroutineInterval(g)}
 	}
 	if len(res) == 0 && id != "" {
+		if closest := closestGoroutineTypes(gs, firstPC, 3); len(closest) > 0 {
+			return nil, fmt.Errorf("failed to find matching goroutines for id: %s (closest goroutine types: %s)", id, strings.Join(closest, ", "))
+		}
 		return nil, fmt.Errorf("failed to find matching goroutines for id: %s", id)
 	}
 	return res, nil
 }
 
+// goroutineInterval returns the lifetime of the goroutine g within the trace.
+func goroutineInterval(g *trace.GDesc) interval {
+	startTime := g.StartTime
+	if startTime == 0 {
+		// The goroutine never started running in the trace. It was
+		// created, if at all, in the trace or before the trace start.
+		startTime = g.CreationTime
+	}
+	if first := firstTimestamp(); startTime < first {
+		startTime = first
+	}
+	endTime := g.EndTime
+	if g.EndTime == 0 {
+		endTime = traceEnd(startTime) // the trace doesn't include the goroutine end event. Use the trace end time.
+	}
+	return interval{begin: startTime, end: endTime}
+}
+
+// pprofMatchingGoroutineIDs restricts gToIntervals to the goroutines whose
+// ids are listed in the comma-separated gids request parameter, as shown in
+// the trace viewer. If gToIntervals is nil, the goroutines are selected among
+// all goroutines, over their lifetime. If the parameter is empty,
+// gToIntervals is returned as is.
+func pprofMatchingGoroutineIDs(r *http.Request, gToIntervals map[uint64][]interval, events []*trace.Event) (map[uint64][]interval, error) {
+	param := r.FormValue("gids")
+	if param == "" {
+		return gToIntervals, nil
+	}
+	gs := analyzeGoroutines(events)
+	res := make(map[uint64][]interval)
+	for _, v := range strings.Split(param, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, &paramError{fmt.Errorf("invalid goroutine id: %v", v)}
+		}
+		g := gs[id]
+		if g == nil {
+			return nil, fmt.Errorf("failed to find goroutine: %d", id)
+		}
+		if gToIntervals == nil {
+			res[id] = []interval{goroutineInterval(g)}
+		} else if intervals, ok := gToIntervals[id]; ok {
+			res[id] = intervals
+		}
+	}
+	return res, nil
+}
+
+// pprofCreatedAfter restricts gToIntervals to the goroutines created at or
+// after the time given by the createdafter request parameter, in nanoseconds
+// relative to the trace start. If gToIntervals is nil, the goroutines are
+// selected among all goroutines. If the parameter is empty, gToIntervals
+// is returned as is.
+func pprofCreatedAfter(r *http.Request, gToIntervals map[uint64][]interval, events []*trace.Event) (map[uint64][]interval, error) {
+	v := r.FormValue("createdafter")
+	if v == "" {
+		return gToIntervals, nil
+	}
+	ts, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, &paramError{fmt.Errorf("invalid createdafter parameter: %v", v)}
+	}
+	cutoff := firstTimestamp() + ts
+	return restrictGoroutines(gToIntervals, events, func(g *trace.GDesc) bool {
+		return g.StartTime >= cutoff
+	}), nil
+}
+
+// pprofMatchingGoroutineNames restricts gToIntervals to the goroutines whose
+// start function names match the regular expression given by the gname
+// request parameter. If gToIntervals is nil, the goroutines are selected
+// among all goroutines. If the parameter is empty, gToIntervals is returned
+// as is.
+func pprofMatchingGoroutineNames(r *http.Request, gToIntervals map[uint64][]interval, events []*trace.Event) (map[uint64][]interval, error) {
+	v := r.FormValue("gname")
+	if v == "" {
+		return gToIntervals, nil
+	}
+	re, err := regexp.Compile(v)
+	if err != nil {
+		return nil, &paramError{fmt.Errorf("invalid gname parameter: %v", err)}
+	}
+	res := restrictGoroutines(gToIntervals, events, func(g *trace.GDesc) bool {
+		return re.MatchString(g.Name)
+	})
+	if len(res) == 0 {
+		return nil, fmt.Errorf("failed to find goroutines matching gname: %s", v)
+	}
+	return res, nil
+}
+
+// restrictGoroutines returns the intervals in gToIntervals of the goroutines
+// for which match returns true. If gToIntervals is nil, the goroutines are
+// selected among all goroutines, over their lifetime.
+func restrictGoroutines(gToIntervals map[uint64][]interval, events []*trace.Event, match func(*trace.GDesc) bool) map[uint64][]interval {
+	res := make(map[uint64][]interval)
+	for id, g := range analyzeGoroutines(events) {
+		if !match(g) {
+			continue
+		}
+		if gToIntervals == nil {
+			res[id] = []interval{goroutineInterval(g)}
+		} else if intervals, ok := gToIntervals[id]; ok {
+			res[id] = intervals
+		}
+	}
+	return res
+}
+
+// closestGoroutineTypes returns up to n of the goroutine types of gs whose
+// ids are the closest to pc, as "id (function)", to suggest a correct id.
+func closestGoroutineTypes(gs map[uint64]*trace.GDesc, pc uint64, n int) []string {
+	names := make(map[uint64]string)
+	for _, g := range gs {
+		if g.PC != 0 {
+			names[g.PC] = g.Name
+		}
+	}
+	pcs := make([]uint64, 0, len(names))
+	for p := range names {
+		pcs = append(pcs, p)
+	}
+	dist := func(p uint64) uint64 {
+		if p < pc {
+			return pc - p
+		}
+		return p - pc
+	}
+	sort.Slice(pcs, func(i, j int) bool {
+		if di, dj := dist(pcs[i]), dist(pcs[j]); di != dj {
+			return di < dj
+		}
+		return pcs[i] < pcs[j]
+	})
+	if len(pcs) > n {
+		pcs = pcs[:n]
+	}
+	var res []string
+	for _, p := range pcs {
+		res = append(res, fmt.Sprintf("%d (%s)", p, names[p]))
+	}
+	return res
+}
+
+// pprofMatchingGoroutineSpans restricts gToIntervals to the intervals of the
+// spans matching the span filter request parameters, so that the goroutine
+// type and span filters can be combined. If no span parameter is specified,
+// gToIntervals is returned as is.
+func pprofMatchingGoroutineSpans(r *http.Request, gToIntervals map[uint64][]interval, nested bool) (map[uint64][]interval, error) {
+	filter, err := newSpanFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(filter.cond) == 0 && !filter.firstOnly {
+		return gToIntervals, nil
+	}
+	spanIntervals, err := pprofMatchingSpans(filter, nested)
+	if err != nil {
+		return nil, err
+	}
+	if gToIntervals == nil {
+		return spanIntervals, nil
+	}
+	res := make(map[uint64][]interval)
+	for g, intervals := range spanIntervals {
+		if i := intersectIntervals(intervals, gToIntervals[g]); len(i) > 0 {
+			res[g] = i
+		}
+	}
+	return res, nil
+}
+
+// intersectIntervals returns the parts of the intervals in a
+// that overlap the intervals in b.
+func intersectIntervals(a, b []interval) []interval {
+	var res []interval
+	for _, x := range a {
+		for _, y := range b {
+			i := interval{begin: x.begin, end: x.end}
+			if i.begin < y.begin {
+				i.begin = y.begin
+			}
+			if y.end < i.end {
+				i.end = y.end
+			}
+			if i.begin < i.end {
+				res = append(res, i)
+			}
+		}
+	}
+	return res
+}
+
+// pprofMatchingTask restricts gToIntervals to the goroutines and time intervals
+// of the task given by the task request parameter and of its descendant tasks,
+// that is, the spans of the tasks, including the implicit spans of goroutines
+// created within them. If the parameter is empty, gToIntervals is returned as is.
+func pprofMatchingTask(r *http.Request, gToIntervals map[uint64][]interval) (map[uint64][]interval, error) {
+	v := r.FormValue("task")
+	if v == "" {
+		return gToIntervals, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return nil, &paramError{fmt.Errorf("invalid task parameter: %v", v)}
+	}
+	res, err := analyzeAnnotations()
+	if err != nil {
+		return nil, err
+	}
+	task, ok := res.tasks[id]
+	if !ok {
+		return nil, fmt.Errorf("failed to find task: %d", id)
+	}
+	taskIntervals := make(map[uint64][]interval)
+	for _, t := range task.decendents() {
+		for _, s := range t.spans {
+			taskIntervals[s.G] = append(taskIntervals[s.G], interval{begin: s.firstTimestamp(), end: s.lastTimestamp()})
+		}
+	}
+	for g, intervals := range taskIntervals {
+		if _, ok := gToIntervals[g]; gToIntervals != nil && !ok {
+			delete(taskIntervals, g) // not of the goroutine type.
+			continue
+		}
+		// Spans of the task tree may be nested.
+		taskIntervals[g] = mergeIntervals(intervals)
+	}
+	return taskIntervals, nil
+}
+
+// pprofRestrictTimeRange restricts the intervals in gToIntervals to the time
+// range specified by the start and end request parameters, in nanoseconds
+// relative to the trace start. If gToIntervals is nil, the intervals of all
+// goroutines are restricted to the time range. If neither parameter is
+// specified, gToIntervals is returned unchanged.
+func pprofRestrictTimeRange(r *http.Request, gToIntervals map[uint64][]interval, events []*trace.Event) (map[uint64][]interval, error) {
+	startStr, endStr := r.FormValue("start"), r.FormValue("end")
+	if startStr == "" && endStr == "" {
+		return gToIntervals, nil
+	}
+	base := firstTimestamp()
+	tr := interval{begin: base, end: lastTimestamp()}
+	if startStr != "" {
+		start, err := strconv.ParseInt(startStr, 10, 64)
+		if err != nil {
+			return nil, &paramError{fmt.Errorf("invalid start time: %v", startStr)}
+		}
+		tr.begin = base + start
+	}
+	if endStr != "" {
+		end, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil {
+			return nil, &paramError{fmt.Errorf("invalid end time: %v", endStr)}
+		}
+		tr.end = base + end
+	}
+	if tr.end < tr.begin {
+		return nil, &paramError{fmt.Errorf("invalid time range: start %v is after end %v", startStr, endStr)}
+	}
+
+	res := make(map[uint64][]interval)
+	if gToIntervals == nil {
+		for id := range analyzeGoroutines(events) {
+			res[id] = []interval{tr}
+		}
+		return res, nil
+	}
+	for g, intervals := range gToIntervals {
+		for _, i := range intervals {
+			if i.end <= tr.begin || tr.end <= i.begin {
+				continue // at most touching the range.
+			}
+			if i.begin < tr.begin {
+				i.begin = tr.begin
+			}
+			if tr.end < i.end {
+				i.end = tr.end
+			}
+			res[g] = append(res[g], i)
+		}
+	}
+	return res, nil
+}
+
+// pprofFilterProcs returns the events that occurred on any of the processors
+// listed in the comma-separated p request parameter. If the parameter is not
+// specified, events are returned unchanged. The events tracking the state of
+// the processors, which are not profiled themselves, are always kept, as the
+// idle processor count of the sched profile needs those of every processor.
+func pprofFilterProcs(r *http.Request, events []*trace.Event) ([]*trace.Event, error) {
+	param := r.FormValue("p")
+	if param == "" {
+		return events, nil
+	}
+	procs := make(map[int]bool)
+	for _, s := range strings.Split(param, ",") {
+		p, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, &paramError{fmt.Errorf("invalid processor id: %v", s)}
+		}
+		procs[p] = true
+	}
+	var res []*trace.Event
+	for _, ev := range events {
+		if procs[ev.P] || procStateEvent(ev.Type) {
+			res = append(res, ev)
+		}
+	}
+	return res, nil
+}
+
+// procStateEvent reports whether events of type typ track the state of the
+// processors rather than that of the goroutines.
+func procStateEvent(typ byte) bool {
+	switch typ {
+	case trace.EvGomaxprocs, trace.EvProcStart, trace.EvProcStop:
+		return true
+	}
+	return false
+}
+
 // pprofMatchingSpans returns the time intervals of matching spans
 // grouped by the goroutine id. If the filter is nil, returns nil without an error.
-func pprofMatchingSpans(filter *spanFilter) (map[uint64][]interval, error) {
+// Unless nested is set, only the outermost of nested matching spans are kept.
+func pprofMatchingSpans(filter *spanFilter, nested bool) (map[uint64][]interval, error) {
 	res, err := analyzeAnnotations()
 	if err != nil {
 		return nil, err
@@ -135,13 +931,27 @@ func pprofMatchingSpans(filter *spanFilter) (map[uint64][]interval, error) {
 	}
 
 	gToIntervals := make(map[uint64][]interval)
+	first := make(map[string]spanDesc) // span name to its earliest matching span, with filter.firstOnly.
 	for id, spans := range res.spans {
 		for _, s := range spans {
-			if filter.match(id, s) {
-				gToIntervals[s.G] = append(gToIntervals[s.G], interval{begin: s.firstTimestamp(), end: s.lastTimestamp()})
+			if !filter.match(id, s) {
+				continue
 			}
+			if filter.firstOnly {
+				if f, ok := first[s.Name]; !ok || s.firstTimestamp() < f.firstTimestamp() {
+					first[s.Name] = s
+				}
+				continue
+			}
+			gToIntervals[s.G] = append(gToIntervals[s.G], interval{begin: s.firstTimestamp(), end: s.lastTimestamp()})
 		}
 	}
+	for _, s := range first {
+		gToIntervals[s.G] = append(gToIntervals[s.G], interval{begin: s.firstTimestamp(), end: s.lastTimestamp()})
+	}
+	if nested {
+		return gToIntervals, nil
+	}
 
 	for g, intervals := range gToIntervals {
 		// in order to remove nested spans and
@@ -171,208 +981,2382 @@ func pprofMatchingSpans(filter *spanFilter) (map[uint64][]interval, error) {
 	return gToIntervals, nil
 }
 
-// computePprofIO generates IO pprof-like profile (time spent in IO wait, currently only network blocking event).
-func computePprofIO(w io.Writer, gToIntervals map[uint64][]interval, events []*trace.Event) error {
-	prof := make(map[uint64]Record)
-	for _, ev := range events {
-		if ev.Type != trace.EvGoBlockNet || ev.Link == nil || ev.StkID == 0 || len(ev.Stk) == 0 {
-			continue
-		}
-		overlapping := pprofOverlappingDuration(gToIntervals, ev)
-		if overlapping > 0 {
-			rec := prof[ev.StkID]
-			rec.stk = ev.Stk
-			rec.n++
-			rec.time += overlapping.Nanoseconds()
-			prof[ev.StkID] = rec
-		}
+// profileKind identifies a kind of pprof-like profile computed from trace events.
+type profileKind int
+
+const (
+	profileIO         profileKind = iota // network blocking
+	profileIORead                        // network blocking waiting to read
+	profileIOWrite                       // network blocking waiting to write
+	profileBlock                         // synchronization blocking
+	profileSyscall                       // syscall blocking
+	profileSched                         // scheduler latency
+	profileExec                          // goroutine execution
+	profileGCAssist                      // GC assist
+	profileGCPause                       // GC stop-the-world pauses
+	profileWait                          // IO, synchronization and syscall blocking, and scheduler latency
+	profileBlockSched                    // synchronization blocking and scheduler latency
+	profileIdle                          // idle Ps
+	profileDNS                           // network blocking during DNS resolution
+	profileLifetime                      // goroutine lifetime
+)
+
+// computeProfile computes the pprof-like profile of the given kind from events,
+// aggregated and built as specified by opts. If opts is nil, the default options
+// are used. If gToIntervals is non-nil, only the time overlapping with the
+// intervals of the corresponding goroutines is accounted for; see
+// pprofOverlappingDuration.
+func computeProfile(kind profileKind, events []*trace.Event, gToIntervals map[uint64][]interval, opts *pprofOptions) (*profile.Profile, error) {
+	k := kind.info()
+	if k == nil {
+		return nil, fmt.Errorf("unknown profile kind: %d", kind)
 	}
-	return buildProfile(prof).Write(w)
+	return computeKindProfile(kind.String(), k, events, gToIntervals, opts)
 }
 
-// computePprofBlock generates blocking pprof-like profile (time spent blocked on synchronization primitives).
-func computePprofBlock(w io.Writer, gToIntervals map[uint64][]interval, events []*trace.Event) error {
-	prof := make(map[uint64]Record)
-	for _, ev := range events {
+// bytesWeightError returns the error for the profile of the kind described
+// by k, named name, weighted by bytes. Only the network blocking profiles
+// could be, but EvGoBlockNet records only the time and stack of the wait,
+// not the bytes the goroutine was waiting to transfer.
+func bytesWeightError(name string, k *pprofKind) error {
+	if len(k.types) == 1 && k.types[0] == trace.EvGoBlockNet {
+		return fmt.Errorf("weight=bytes is not supported by this trace: network blocking events do not record byte counts")
+	}
+	return fmt.Errorf("weight=bytes is not supported by the %s profile: only network blocking profiles can be weighted by bytes", name)
+}
+
+// computeKindProfile is like computeProfile for the profile kind described
+// by k, which need not be registered in profileKinds, named name.
+func computeKindProfile(name string, k *pprofKind, events []*trace.Event, gToIntervals map[uint64][]interval, opts *pprofOptions) (*profile.Profile, error) {
+	prof := newPprofRecords(opts)
+	prof.kind = name
+	if prof.opts.weightBytes {
+		return nil, bytesWeightError(name, k)
+	}
+	if !prof.opts.nested {
+		gToIntervals = mergeGoroutineIntervals(gToIntervals)
+	}
+	if err := k.addRecords(prof, gToIntervals, events); err != nil {
+		return nil, err
+	}
+	p := buildProfile(prof)
+	if prof.opts.summary {
+		p.Comments = append(p.Comments, durationSummary(prof.durations))
+	}
+	return p, nil
+}
+
+// durationSummary returns a summary of the distribution of the durations,
+// with their count and percentiles, which is added to the profile comments.
+func durationSummary(durations []time.Duration) string {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p int) time.Duration {
+		if len(sorted) == 0 {
+			return 0
+		}
+		// Nearest-rank percentile.
+		i := (p*len(sorted)+99)/100 - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+	return fmt.Sprintf("%scount=%d p50=%v p90=%v p99=%v max=%v", summaryPrefix,
+		len(sorted), percentile(50), percentile(90), percentile(99), percentile(100))
+}
+
+// summaryPrefix starts the profile comment added by durationSummary.
+const summaryPrefix = "summary: "
+
+// pprofKindRecords adds to prof the records of the pprof-like profile of the given kind.
+// It returns the context error if the request is canceled meanwhile.
+func pprofKindRecords(prof *pprofRecords, kind profileKind, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+	k := kind.info()
+	if k == nil {
+		return fmt.Errorf("unknown profile kind: %d", kind)
+	}
+	return k.addRecords(prof, gToIntervals, events)
+}
+
+// addRecords adds to prof the records of the pprof-like profile of the kind described by k.
+func (k *pprofKind) addRecords(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+	prof.reasonLabel = k.reasonLabel
+	if k.types == nil {
+		return k.records(prof, gToIntervals, events)
+	}
+	events = selectEvents(events, k.types)
+	shards := runtime.GOMAXPROCS(0) // NumCPU unless limited.
+	if n := len(events) / minShardEvents; n < shards {
+		shards = n
+	}
+	if (k.sequential != nil && k.sequential(prof.opts)) || shards <= 1 {
+		return k.records(prof, gToIntervals, events)
+	}
+
+	// Scan shards of events in parallel, then merge the partial records.
+	parts := make([]*pprofRecords, shards)
+	errs := make([]error, shards)
+	size := (len(events) + shards - 1) / shards
+	var wg sync.WaitGroup
+	for i := range parts {
+		shard := events[i*size:]
+		if len(shard) > size {
+			shard = shard[:size]
+		}
+		parts[i] = newPprofRecords(prof.opts)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = k.records(parts[i], gToIntervals, shard)
+		}(i)
+	}
+	wg.Wait()
+	for i, part := range parts {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		prof.merge(part)
+	}
+	return nil
+}
+
+// eventIndex indexes the events of the loaded trace by type, so that
+// profiles only look at the events of the types they are interested in.
+var eventIndex struct {
+	mu     sync.Mutex
+	events []*trace.Event // the indexed events.
+	pos    map[byte][]int // event type to the positions of the events.
+}
+
+// selectEvents returns the events of the given types, in order.
+// If events are the events of the loaded trace, as opposed to, e.g., events
+// filtered by P, they are looked up in eventIndex, which is built once.
+func selectEvents(events []*trace.Event, types []byte) []*trace.Event {
+	all, err := parseEvents()
+	if err != nil || len(events) == 0 || len(events) != len(all) || &events[0] != &all[0] {
+		var res []*trace.Event
+		for _, ev := range events {
+			for _, typ := range types {
+				if ev.Type == typ {
+					res = append(res, ev)
+					break
+				}
+			}
+		}
+		return res
+	}
+
+	eventIndex.mu.Lock()
+	if len(eventIndex.events) != len(events) || &eventIndex.events[0] != &events[0] {
+		eventIndex.events = events
+		eventIndex.pos = make(map[byte][]int)
+		for i, ev := range events {
+			eventIndex.pos[ev.Type] = append(eventIndex.pos[ev.Type], i)
+		}
+	}
+	var pos []int
+	for _, typ := range types {
+		pos = append(pos, eventIndex.pos[typ]...)
+	}
+	eventIndex.mu.Unlock()
+	sort.Ints(pos)
+	res := make([]*trace.Event, len(pos))
+	for i, p := range pos {
+		res[i] = events[p]
+	}
+	return res
+}
+
+// minShardEvents is the minimum number of events
+// per shard when events are scanned in parallel.
+var minShardEvents = 1 << 16
+
+// recordsFunc adds to prof the records of a pprof-like profile computed from
+// events, accounting only the time within gToIntervals, if non-nil.
+type recordsFunc func(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error
+
+// pprofKind describes how the pprof-like profile of a kind is computed.
+type pprofKind struct {
+	kind    profileKind
+	records recordsFunc
+
+	// types are the types of the events the records function looks at,
+	// which are the only events passed to it. If nil, it gets all events.
+	types []byte
+
+	// sequential reports whether, given the options, the records function
+	// must see all the events at once, because it tracks state across events.
+	// Otherwise, the events are split into shards scanned in parallel.
+	// If nil, the events are always scanned in parallel.
+	sequential func(opts *pprofOptions) bool
+
+	// reasonLabel is the name of the label holding the reasons the
+	// records function accounts the time for, if not "reason".
+	reasonLabel string
+}
+
+// profileKinds is the registry of the profile kinds, keyed by their names,
+// as used in the paths of the profile endpoints and the -pprof flag.
+// Each kind is served at /<name> and, restricted to spans, at /span<name>.
+var profileKinds = map[string]*pprofKind{
+	"io": {
+		kind:    profileIO,
+		records: pprofIODirRecords(""),
+		types:   []byte{trace.EvGoBlockNet},
+	},
+	"ioread": {
+		kind:    profileIORead,
+		records: pprofIODirRecords("read"),
+		types:   []byte{trace.EvGoBlockNet},
+	},
+	"iowrite": {
+		kind:    profileIOWrite,
+		records: pprofIODirRecords("write"),
+		types:   []byte{trace.EvGoBlockNet},
+	},
+	"dns": {
+		kind:    profileDNS,
+		records: pprofDNSRecords,
+		types:   []byte{trace.EvGoBlockNet},
+	},
+	"block": {
+		kind:    profileBlock,
+		records: pprofBlockRecords,
+		types:   []byte{trace.EvGoBlockSend, trace.EvGoBlockRecv, trace.EvGoBlockSelect, trace.EvGoBlockSync, trace.EvGoBlockCond},
+	},
+	"syscall": {
+		kind:    profileSyscall,
+		records: pprofSyscallRecords,
+		types:   []byte{trace.EvGoSysCall, trace.EvGoSysBlock},
+		// Pairs syscalls with their EvGoSysBlock.
+		sequential:  func(opts *pprofOptions) bool { return opts.blockedOnly },
+		reasonLabel: "syscall",
+	},
+	"sched": {
+		kind:    profileSched,
+		records: pprofSchedRecords,
+		types:   []byte{trace.EvGoUnblock, trace.EvGoCreate, trace.EvGomaxprocs, trace.EvProcStart, trace.EvProcStop},
+		// Tracks the idle Ps, for the idleP option.
+		sequential: func(opts *pprofOptions) bool { return opts.idleP },
+	},
+	"exec": {
+		kind:    profileExec,
+		records: pprofExecRecords,
+		types:   []byte{trace.EvGoStart, trace.EvGoStartLabel},
+	},
+	"gcassist": {
+		kind:        profileGCAssist,
+		records:     pprofGCAssistRecords,
+		types:       []byte{trace.EvGCMarkAssistStart, trace.EvGoBlockGC, trace.EvGCSweepStart},
+		sequential:  alwaysSequential, // tracks the mark assists in progress.
+		reasonLabel: "phase",
+	},
+	"gcpause": {
+		kind:       profileGCPause,
+		records:    pprofGCPauseRecords,
+		types:      []byte{trace.EvGCStart, trace.EvGCSTWStart},
+		sequential: alwaysSequential, // tracks the current GC cycle.
+	},
+	"idle": {
+		kind:    profileIdle,
+		records: pprofIdleRecords, // needs the events of the goroutines, whatever their types.
+	},
+	"lifetime": {
+		kind:        profileLifetime,
+		records:     pprofLifetimeRecords,
+		types:       []byte{trace.EvGoCreate, trace.EvGoEnd},
+		sequential:  alwaysSequential, // pairs the goroutine creations with their ends.
+		reasonLabel: "state",
+	},
+	// The records of the combined profiles are set by init, as they
+	// are computed from the other kinds, referring to profileKinds.
+	"wait": {
+		kind: profileWait,
+	},
+	"blocksched": {
+		kind: profileBlockSched,
+	},
+}
+
+func init() {
+	profileKinds["wait"].records = pprofCombinedRecords(waitKinds)
+	profileKinds["blocksched"].records = pprofCombinedRecords(blockSchedKinds)
+}
+
+func alwaysSequential(*pprofOptions) bool { return true }
+
+// info returns the description of the profile kind, or nil if unknown.
+func (kind profileKind) info() *pprofKind {
+	for _, k := range profileKinds {
+		if k.kind == kind {
+			return k
+		}
+	}
+	return nil
+}
+
+func (kind profileKind) String() string {
+	for name, k := range profileKinds {
+		if k.kind == kind {
+			return name
+		}
+	}
+	return fmt.Sprintf("profileKind(%d)", int(kind))
+}
+
+// pprofDiff generates the pprof-like profile of the kind given by the kind
+// request parameter, whose values are the differences between the profiles
+// of the traces given by the b and a parameters (b minus a). The traces are
+// referenced by name or index as given on the command line. Records are
+// matched by stack, and negative values are preserved so that both
+// regressions and improvements are visible.
+func pprofDiff(w io.Writer, r *http.Request) error {
+	k, ok := profileKinds[r.FormValue("kind")]
+	if !ok {
+		return &paramError{fmt.Errorf("invalid kind parameter: %q", r.FormValue("kind"))}
+	}
+	kind := k.kind
+	opts, err := newPprofOptions(r)
+	if err != nil {
+		return &paramError{err}
+	}
+	opts.byLabel = false // goroutines and Ps do not correspond across traces.
+	events, err := parseEvents()
+	if err != nil {
+		return err
+	}
+	opts.setGoroutines(events) // the goroutines of the merged traces.
+	a, err := traceByRef(r.FormValue("a"))
+	if err != nil {
+		return err
+	}
+	b, err := traceByRef(r.FormValue("b"))
+	if err != nil {
+		return err
+	}
+	base := newPprofRecords(opts)
+	if err := pprofKindRecords(base, kind, nil, a.Events); err != nil {
+		return err
+	}
+	prof := newPprofRecords(opts)
+	prof.kind = fmt.Sprintf("%v diff (%s minus %s)", kind, r.FormValue("b"), r.FormValue("a"))
+	if err := pprofKindRecords(prof, kind, nil, b.Events); err != nil {
+		return err
+	}
+	prof.subtract(base)
+	return buildProfile(prof).Write(w)
+}
+
+// pprofGoroutineCount generates a pprof-like profile of the goroutine
+// population, to find where goroutines pile up or leak. For each creation
+// stack (the stack of the go statement), the profile holds the number of
+// goroutines created there and the peak number of them alive at the same
+// time. The id request parameter restricts it to a goroutine type.
+func pprofGoroutineCount(w io.Writer, r *http.Request) error {
+	opts, err := newPprofOptions(r)
+	if err != nil {
+		return &paramError{err}
+	}
+	opts.byLabel = false         // the values are not per goroutine.
+	opts.unit = delayUnits["ns"] // the values are counts, not to be scaled.
+	opts.avg = false             // the values are not delays.
+	events, err := parseEvents()
+	if err != nil {
+		return err
+	}
+	opts.setGoroutines(events)
+	matching, err := pprofMatchingGoroutines(r.FormValue("id"), events)
+	if err != nil {
+		return err
+	}
+	prof := newPprofRecords(opts)
+	prof.kind = "goroutinecount"
+	if err := pprofGoroutineCountRecords(prof, matching, events); err != nil {
+		return err
+	}
+	if len(prof.recs) == 0 {
+		return &emptyProfileError{kind: "goroutine creation"}
+	}
+	p := buildProfile(prof)
+	p.SampleType = []*profile.ValueType{
+		{Type: "goroutines", Unit: "count"},
+		{Type: "peak_live", Unit: "count"},
+	}
+	p.DefaultSampleType = "peak_live"
+	return p.Write(w)
+}
+
+// pprofRunning generates a pprof-like profile of the goroutines running at
+// the instant given by the at request parameter, in nanoseconds relative to
+// the trace start, like a CPU profile sample of the whole program at that
+// instant. It has one sample per goroutine, labeled with the goroutine and P,
+// holding the time the goroutine has been running for at the instant.
+func pprofRunning(w io.Writer, r *http.Request) error {
+	opts, err := newPprofOptions(r)
+	if err != nil {
+		return &paramError{err}
+	}
+	opts.byLabel = true // a sample per goroutine.
+	opts.avg = false    // a single event per goroutine.
+	v := r.FormValue("at")
+	at, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return &paramError{fmt.Errorf("invalid at parameter: %q", v)}
+	}
+	events, err := parseEvents()
+	if err != nil {
+		return err
+	}
+	opts.setGoroutines(events)
+	ts := firstTimestamp() + at
+	if at < 0 || ts > lastTimestamp() {
+		return &paramError{fmt.Errorf("at parameter %d is outside the trace", at)}
+	}
+	prof := newPprofRecords(opts)
+	prof.kind = "running"
+	if err := pprofRunningRecords(prof, events, ts); err != nil {
+		return err
+	}
+	if len(prof.recs) == 0 {
+		return &emptyProfileError{kind: "running goroutine"}
+	}
+	p := buildProfile(prof)
+	p.SampleType[0] = &profile.ValueType{Type: "goroutines", Unit: "count"}
+	p.SampleType[1].Type = "running"
+	p.DefaultSampleType = "running"
+	return p.Write(w)
+}
+
+// pprofCustom generates the pprof-like profile of the events of the types
+// given by the types request parameter, a comma-separated list of numeric
+// event types, such as the custom events of a patched runtime. The time
+// between each event and the event it is linked to, if any, is accounted
+// for at the event's stack. The goroutine filters of the other profiles apply.
+func pprofCustom(w io.Writer, r *http.Request) error {
+	types, err := customEventTypes(r.FormValue("types"))
+	if err != nil {
+		return &paramError{err}
+	}
+	k := &pprofKind{records: pprofLinkedRecords, types: types}
+	return pprofByGoroutine(func(w io.Writer, gToIntervals map[uint64][]interval, events []*trace.Event, opts *pprofOptions) error {
+		p, err := computeKindProfile("custom", k, events, gToIntervals, opts)
+		if err != nil {
+			return err
+		}
+		if len(p.Sample) == 0 {
+			return &emptyProfileError{kind: "custom"}
+		}
+		return p.Write(w)
+	})(w, r)
+}
+
+// customEventTypes parses the comma-separated list of event types v.
+func customEventTypes(v string) ([]byte, error) {
+	if v == "" {
+		return nil, fmt.Errorf("missing types parameter")
+	}
+	var types []byte
+	for _, s := range strings.Split(v, ",") {
+		typ, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+		if err != nil || typ == trace.EvNone || typ >= trace.EvCount {
+			return nil, fmt.Errorf("invalid event type %q: must be between %d and %d", s, trace.EvNone+1, trace.EvCount-1)
+		}
+		types = append(types, byte(typ))
+	}
+	return types, nil
+}
+
+// pprofLinkedRecords adds to prof the records of the time between
+// the events and the events they are linked to, whatever their types.
+func pprofLinkedRecords(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+	for i, ev := range events {
+		if err := prof.checkCanceled(i); err != nil {
+			return err
+		}
+		if ev.Link == nil {
+			continue
+		}
+		overlapping := prof.overlappingDuration(gToIntervals, ev)
+		if overlapping > 0 {
+			prof.add(ev, ev.StkID, ev.Stk, overlapping)
+		}
+	}
+	return nil
+}
+
+// pprofRunningRecords adds to prof the records of the goroutines running at
+// the timestamp ts. The trace only records stacks at events, so a goroutine's
+// stack at ts is taken from its last event with a stack since it started
+// running, or else from the event where it stopped running.
+func pprofRunningRecords(prof *pprofRecords, events []*trace.Event, ts int64) error {
+	running := make(map[uint64]*trace.Event) // goroutine id to its last start event
+	last := make(map[uint64]*trace.Event)    // goroutine id to its last event with a stack since then
+	for i, ev := range events {
+		if err := prof.checkCanceled(i); err != nil {
+			return err
+		}
+		if ev.Ts > ts {
+			break
+		}
+		switch ev.Type {
+		case trace.EvGoStart, trace.EvGoStartLabel:
+			running[ev.G] = ev
+			delete(last, ev.G)
+			continue
+		}
+		if _, ok := running[ev.G]; ok && ev.StkID != 0 && len(ev.Stk) != 0 {
+			last[ev.G] = ev
+		}
+	}
+	for g, start := range running {
+		if start.Link != nil && start.Link.Ts <= ts {
+			continue // stopped running before ts.
+		}
+		stkID, stk := start.StkID, start.Stk
+		if ev := last[g]; ev != nil {
+			stkID, stk = ev.StkID, ev.Stk
+		} else if start.Link != nil && start.Link.StkID != 0 && len(start.Link.Stk) != 0 {
+			stkID, stk = start.Link.StkID, start.Link.Stk
+		}
+		prof.add(start, stkID, stk, time.Duration(ts-start.Ts))
+	}
+	return nil
+}
+
+// pprofGoroutineCountRecords adds to prof the records of the goroutine
+// population profile, with Record.n holding the number of goroutines
+// created at each stack and Record.time the peak number of them alive.
+// If matching is non-nil, only the goroutines in it are counted.
+func pprofGoroutineCountRecords(prof *pprofRecords, matching map[uint64][]interval, events []*trace.Event) error {
+	live := make(map[uint64]int64)      // creation stack id to the number of live goroutines
+	creation := make(map[uint64]uint64) // live goroutine id to its creation stack id
+	for i, ev := range events {
+		if err := prof.checkCanceled(i); err != nil {
+			return err
+		}
+		switch ev.Type {
+		case trace.EvGoCreate:
+			g := ev.Args[0]
+			if _, ok := matching[g]; matching != nil && !ok {
+				continue
+			}
+			if ev.StkID == 0 || len(ev.Stk) == 0 {
+				prof.dropped++
+				continue
+			}
+			creation[g] = ev.StkID
+			live[ev.StkID]++
+			key := recordKey{stkID: ev.StkID}
+			rec := prof.recs[key]
+			rec.stk = ev.Stk
+			rec.n++
+			if live[ev.StkID] > rec.time {
+				rec.time = live[ev.StkID]
+			}
+			prof.recs[key] = rec
+		case trace.EvGoEnd:
+			if stkID, ok := creation[ev.G]; ok {
+				live[stkID]--
+				delete(creation, ev.G)
+			}
+		}
+	}
+	return nil
+}
+
+// subtract subtracts the records of base from the records of prof.
+// Records are matched by their stack frames rather than stack ids,
+// which are specific to a trace, and by all their labels.
+func (prof *pprofRecords) subtract(base *pprofRecords) {
+	keys := make(map[string]recordKey)
+	var maxStkID uint64
+	for key, rec := range prof.recs {
+		keys[key.signature(rec.stk)] = key
+		if key.stkID > maxStkID {
+			maxStkID = key.stkID
+		}
+	}
+	for key, rec := range base.recs {
+		sig := key.signature(rec.stk)
+		k, ok := keys[sig]
+		if !ok {
+			// The stack ids of base are unrelated to those of prof.
+			maxStkID++
+			k = key
+			k.stkID = maxStkID
+			keys[sig] = k
+		}
+		diff := prof.recs[k]
+		diff.stk = rec.stk
+		diff.n -= rec.n
+		diff.time -= rec.time
+		prof.recs[k] = diff
+	}
+}
+
+// signature returns a string identifying the record of the key with the
+// stack stk across traces: the key but its stack id, and the stack frames.
+func (k recordKey) signature(stk []*trace.Frame) string {
+	return fmt.Sprintf("%d %d %d %q %q\n%s", k.g, k.p, k.bucket, k.reason, k.labels, stackSignature(stk))
+}
+
+// stackSignature returns a string identifying the functions,
+// files and lines of the frames of stk, independent of the PCs.
+func stackSignature(stk []*trace.Frame) string {
+	var b strings.Builder
+	for _, frame := range stk {
+		fmt.Fprintf(&b, "%s %s:%d\n", frame.Fn, frame.File, frame.Line)
+	}
+	return b.String()
+}
+
+// computePprof computes the pprof-like profile of the given kind and writes it to w.
+func computePprof(w io.Writer, kind profileKind, gToIntervals map[uint64][]interval, events []*trace.Event, opts *pprofOptions) error {
+	p, err := computeProfile(kind, events, gToIntervals, opts)
+	if err != nil {
+		return err
+	}
+	if len(p.Sample) == 0 {
+		return &emptyProfileError{kind: kind.String()}
+	}
+	return p.Write(w)
+}
+
+// computePprofKind returns the function generating the pprof-like profile of the given kind.
+func computePprofKind(kind profileKind) func(io.Writer, map[uint64][]interval, []*trace.Event, *pprofOptions) error {
+	return func(w io.Writer, gToIntervals map[uint64][]interval, events []*trace.Event, opts *pprofOptions) error {
+		return computePprof(w, kind, gToIntervals, events, opts)
+	}
+}
+
+// emptyProfileError is returned instead of a profile without samples,
+// which pprof renders as a blank graph, indistinguishable from a failure.
+type emptyProfileError struct {
+	kind string
+}
+
+func (e *emptyProfileError) Error() string {
+	return fmt.Sprintf("no %s events found in the selected range", e.kind)
+}
+
+// paramError is returned for invalid request parameters,
+// as opposed to failures to compute the profile.
+type paramError struct {
+	err error
+}
+
+func (e *paramError) Error() string {
+	return e.err.Error()
+}
+
+// pprofIORecords adds to prof the records of IO pprof-like profile (time spent in IO wait,
+// currently only network blocking event) including only the network blocking
+// events whose stack matches. If match is nil, all network blocking events are included.
+func pprofIORecords(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event, match func(stk []*trace.Frame) bool) error {
+	for i, ev := range events {
+		if err := prof.checkCanceled(i); err != nil {
+			return err
+		}
+		if ev.Type != trace.EvGoBlockNet || ev.Link == nil {
+			continue
+		}
+		if match != nil && !match(ev.Stk) {
+			continue
+		}
+		overlapping := prof.overlappingDuration(gToIntervals, ev)
+		if overlapping > 0 {
+			prof.add(ev, ev.StkID, ev.Stk, overlapping)
+		}
+	}
+	return nil
+}
+
+// pprofIODirRecords returns the records function of the IO pprof-like profile
+// restricted to the direction dir ("read" or "write") as reported by
+// netBlockDirection. If dir is empty, all network blocking events are included.
+func pprofIODirRecords(dir string) recordsFunc {
+	return func(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+		if dir == "" {
+			return pprofIORecords(prof, gToIntervals, events, nil)
+		}
+		return pprofIORecords(prof, gToIntervals, events, func(stk []*trace.Frame) bool {
+			return netBlockDirection(stk) == dir
+		})
+	}
+}
+
+// pprofDNSRecords adds to prof the records of the IO pprof-like profile
+// restricted to the network blocking in DNS resolution; see isDNSStack.
+func pprofDNSRecords(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+	return pprofIORecords(prof, gToIntervals, events, isDNSStack)
+}
+
+// dnsFuncPrefixes are the prefixes of the names of the functions
+// of the net package's pure Go DNS resolver and lookups.
+var dnsFuncPrefixes = []string{"net.(*Resolver).", "net.lookup", "net.goLookup", "net.dns"}
+
+// isDNSStack reports whether the network blocking stack stk is resolving
+// a name. The trace does not record what the connection is used for, so it
+// is inferred from the DNS resolver functions in the stack. Lookups done by
+// the cgo resolver block in syscalls instead, and do not appear in the profile.
+func isDNSStack(stk []*trace.Frame) bool {
+	for _, frame := range stk {
+		for _, prefix := range dnsFuncPrefixes {
+			if strings.HasPrefix(frame.Fn, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// netBlockDirection reports whether the network blocking stack stk is waiting
+// for the file descriptor to become readable ("read") or writable ("write").
+// The trace does not record the direction, so it is inferred from the netpoll
+// wait function in the stack or, as the stacks recorded by the runtime usually
+// start above it, from the internal/poll function calling it. It returns "" if
+// the direction is unknown.
+func netBlockDirection(stk []*trace.Frame) string {
+	for _, frame := range stk {
+		switch {
+		case strings.HasSuffix(frame.Fn, ".waitRead"):
+			return "read"
+		case strings.HasSuffix(frame.Fn, ".waitWrite"):
+			return "write"
+		}
+		if dir, ok := netPollDirections[frame.Fn]; ok {
+			return dir
+		}
+	}
+	return ""
+}
+
+// netPollDirections maps the internal/poll functions waiting for file
+// descriptors to the direction they wait for.
+var netPollDirections = map[string]string{
+	"internal/poll.(*FD).Accept":     "read",
+	"internal/poll.(*FD).RawRead":    "read",
+	"internal/poll.(*FD).Read":       "read",
+	"internal/poll.(*FD).ReadDirent": "read",
+	"internal/poll.(*FD).ReadFrom":   "read",
+	"internal/poll.(*FD).ReadMsg":    "read",
+	"internal/poll.(*FD).RawWrite":   "write",
+	"internal/poll.(*FD).WaitWrite":  "write", // as in net.(*netFD).connect.
+	"internal/poll.(*FD).Write":      "write",
+	"internal/poll.(*FD).WriteMsg":   "write",
+	"internal/poll.(*FD).WriteTo":    "write",
+	"internal/poll.(*FD).Writev":     "write",
+	"internal/poll.SendFile":         "write",
+}
+
+// pprofBlockRecords adds to prof the records of blocking pprof-like profile (time spent blocked on synchronization primitives).
+// The blocking events do not record the channel or mutex blocked on, so the
+// records cannot be keyed by object, only by the stack of the blocking call.
+func pprofBlockRecords(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+	for i, ev := range events {
+		if err := prof.checkCanceled(i); err != nil {
+			return err
+		}
 		switch ev.Type {
 		case trace.EvGoBlockSend, trace.EvGoBlockRecv, trace.EvGoBlockSelect,
-			trace.EvGoBlockSync, trace.EvGoBlockCond, trace.EvGoBlockGC:
-			// TODO(hyangah): figure out why EvGoBlockGC should be here.
-			// EvGoBlockGC indicates the goroutine blocks on GC assist, not
-			// on synchronization primitives.
+			trace.EvGoBlockSync, trace.EvGoBlockCond:
+		default:
+			continue
+		}
+		if prof.opts.blockTypes != nil && !prof.opts.blockTypes[ev.Type] {
+			continue
+		}
+		if ev.Link == nil {
+			continue
+		}
+		overlapping := prof.overlappingDuration(gToIntervals, ev)
+		if overlapping > 0 {
+			prof.add(ev, ev.StkID, ev.Stk, overlapping)
+		}
+	}
+	return nil
+}
+
+// pprofGCAssistRecords adds to prof the records of GC assist pprof-like profile (time spent
+// blocked on GC assist and performing GC mark assist work, or sweeping spans to allocate).
+// The samples are labeled with the GC phase of the assist, "mark" or "sweep".
+// Assists run in the allocating goroutine, from mallocgc, and their events
+// record its stack, so the samples are at the allocation sites causing them,
+// below the runtime frames that the hideruntime parameter removes.
+func pprofGCAssistRecords(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+	assists := make(map[uint64]*trace.Event) // goroutine id to the last mark assist start event
+	for i, ev := range events {
+		if err := prof.checkCanceled(i); err != nil {
+			return err
+		}
+		phase := "mark"
+		switch ev.Type {
+		case trace.EvGCMarkAssistStart:
+			// A mark assist still in progress at the end of the trace
+			// has no linked event; it is counted until the trace end.
+			assists[ev.G] = ev
+		case trace.EvGoBlockGC:
+			// Goroutines block on GC assist from within a mark assist,
+			// so the blocked time is already covered by the assist.
+			// Count it separately only if the assist was not traced.
+			if a := assists[ev.G]; a != nil && (a.Link == nil || ev.Ts < a.Link.Ts) {
+				continue
+			}
+			if ev.Link == nil {
+				continue
+			}
+		case trace.EvGCSweepStart:
+			// Goroutines sweep spans themselves when they allocate
+			// before the background sweeper is done.
+			if ev.G == 0 || ev.Link == nil {
+				continue
+			}
+			phase = "sweep"
+		default:
+			continue
+		}
+		overlapping := prof.overlappingDuration(gToIntervals, ev)
+		if overlapping > 0 {
+			prof.addReason(ev, ev.StkID, ev.Stk, overlapping, phase)
+		}
+	}
+	return nil
+}
+
+// combinedKind is a profile kind combined with others in a single profile,
+// along with the value of the reason label of its samples there.
+type combinedKind struct {
+	reason string
+	kind   profileKind
+}
+
+// waitKinds lists the profiles combined in the wait profile (time goroutines
+// spent off-CPU: blocked on IO, synchronization or syscalls, or waiting to
+// be scheduled).
+var waitKinds = []combinedKind{
+	{"io", profileIO},
+	{"block", profileBlock},
+	{"syscall", profileSyscall},
+	{"sched", profileSched},
+}
+
+// blockSchedKinds lists the profiles combined in the blocksched profile
+// (time goroutines spent blocked on synchronization or waiting to be
+// scheduled), which shows what delays the goroutines of a span, say,
+// besides IO and syscalls.
+var blockSchedKinds = []combinedKind{
+	{"block", profileBlock},
+	{"sched", profileSched},
+}
+
+// pprofCombinedRecords returns the records function of the pprof-like profile
+// combining the profiles of the given kinds. The records are keyed by the
+// reason of the kind they come from, which is kept as a label.
+func pprofCombinedRecords(kinds []combinedKind) recordsFunc {
+	return func(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+		for _, c := range kinds {
+			part := newPprofRecords(prof.opts)
+			if err := pprofKindRecords(part, c.kind, gToIntervals, events); err != nil {
+				return err
+			}
+			for key, rec := range part.recs {
+				key.reason = c.reason
+				r := prof.recs[key]
+				r.stk = rec.stk
+				r.n += rec.n
+				r.time += rec.time
+				prof.recs[key] = r
+			}
+			prof.durations = append(prof.durations, part.durations...)
+			prof.dropped += part.dropped
+			prof.droppedTime += part.droppedTime
+			prof.skewed += part.skewed
+		}
+		return nil
+	}
+}
+
+// pprofGCPauseRecords adds to prof the records of GC pause pprof-like profile
+// (time spent in stop-the-world GC pauses). Each pause is attributed to the
+// stack that started the GC cycle it belongs to.
+func pprofGCPauseRecords(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+	// A pause stops all goroutines, so it is accounted for
+	// whenever it overlaps the intervals of any goroutine.
+	var pauseIntervals map[uint64][]interval
+	if gToIntervals != nil {
+		var all []interval
+		for _, intervals := range gToIntervals {
+			all = append(all, intervals...)
+		}
+		pauseIntervals = map[uint64][]interval{0: mergeIntervals(all)}
+	}
+	var gc *trace.Event // start of the current GC cycle.
+	for i, ev := range events {
+		if err := prof.checkCanceled(i); err != nil {
+			return err
+		}
+		switch ev.Type {
+		case trace.EvGCStart:
+			gc = ev
+		case trace.EvGCSTWStart:
+			if gc == nil || ev.Link == nil {
+				continue
+			}
+			overlapping := prof.overlappingDuration(pauseIntervals, ev)
+			if overlapping > 0 {
+				prof.add(ev, gc.StkID, gc.Stk, overlapping)
+			}
+		}
+	}
+	return nil
+}
+
+// pprofIdleRecords adds to prof the records of idle P pprof-like profile (time Ps
+// spent stopped for lack of work, from EvProcStop to the next EvProcStart).
+// The idle time of a P is attributed to the goroutine that last ran on it,
+// at the stack of its last event on the P, to find the workloads that do
+// not keep the Ps busy.
+func pprofIdleRecords(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+	last := make(map[int]*trace.Event)    // P to the last event with a stack of a goroutine on it
+	stopped := make(map[int]*trace.Event) // P to the event that stopped it
+	for i, ev := range events {
+		if err := prof.checkCanceled(i); err != nil {
+			return err
+		}
+		switch ev.Type {
+		case trace.EvProcStop:
+			stopped[ev.P] = ev
+		case trace.EvProcStart:
+			stop, g := stopped[ev.P], last[ev.P]
+			delete(stopped, ev.P)
+			if stop == nil || g == nil {
+				continue
+			}
+			// The idle time, accounted to the goroutine g.
+			idle := *g
+			idle.Type, idle.Ts, idle.Link = stop.Type, stop.Ts, ev
+			overlapping := prof.overlappingDuration(gToIntervals, &idle)
+			if overlapping > 0 {
+				prof.add(&idle, g.StkID, g.Stk, overlapping)
+			}
+		default:
+			if ev.G != 0 && ev.StkID != 0 {
+				last[ev.P] = ev
+			}
+		}
+	}
+	return nil
+}
+
+// pprofLifetimeRecords adds to prof the records of goroutine lifetime pprof-like
+// profile (time from the creation of goroutines to their end, or the trace end),
+// attributed to the stack of the go statement that created them. Goroutines that
+// did not end in the trace, which may have leaked, are labeled "unfinished".
+func pprofLifetimeRecords(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+	created := make(map[uint64]*trace.Event) // goroutine id to its creation event
+	account := func(create, end *trace.Event, state string) {
+		// The lifetime, accounted to the created goroutine.
+		life := *create
+		life.G, life.Link = create.Args[0], end
+		overlapping := prof.overlappingDuration(gToIntervals, &life)
+		if overlapping > 0 {
+			prof.addReason(&life, create.StkID, create.Stk, overlapping, state)
+		}
+	}
+	for i, ev := range events {
+		if err := prof.checkCanceled(i); err != nil {
+			return err
+		}
+		switch ev.Type {
+		case trace.EvGoCreate:
+			created[ev.Args[0]] = ev
+		case trace.EvGoEnd:
+			if create := created[ev.G]; create != nil {
+				delete(created, ev.G)
+				account(create, ev, "")
+			}
+		}
+	}
+	for _, create := range created {
+		account(create, nil, "unfinished")
+	}
+	return nil
+}
+
+// pprofSyscallRecords adds to prof the records of syscall pprof-like profile (time spent blocked in syscalls).
+// Only syscalls that blocked have a linked exit event, so quick syscalls are not included.
+// With the blockedOnly option, only the time from EvGoSysBlock to the exit is accounted.
+// Samples are labeled with the name of the syscall, as inferred by syscallName.
+func pprofSyscallRecords(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+	syscalls := make(map[uint64]*trace.Event) // goroutine id to its syscall in progress
+	for i, ev := range events {
+		if err := prof.checkCanceled(i); err != nil {
+			return err
+		}
+		if prof.opts.blockedOnly {
+			switch ev.Type {
+			case trace.EvGoSysCall:
+				syscalls[ev.G] = ev
+				continue
+			case trace.EvGoSysBlock:
+				sc := syscalls[ev.G]
+				delete(syscalls, ev.G)
+				if sc == nil || sc.Link == nil {
+					continue
+				}
+				blocked := *sc
+				blocked.Ts = ev.Ts
+				overlapping := prof.overlappingDuration(gToIntervals, &blocked)
+				if overlapping > 0 {
+					prof.addReason(sc, sc.StkID, sc.Stk, overlapping, syscallName(sc.Stk))
+				}
+			}
+			continue
+		}
+		if ev.Type != trace.EvGoSysCall || ev.Link == nil {
+			continue
+		}
+		overlapping := prof.overlappingDuration(gToIntervals, ev)
+		if overlapping > 0 {
+			prof.addReason(ev, ev.StkID, ev.Stk, overlapping, syscallName(ev.Stk))
+		}
+	}
+	return nil
+}
+
+// syscallName returns the name of the syscall made at the stack stk.
+// The trace does not record the syscall number, so the name is inferred
+// from the innermost frame that is neither in the runtime nor a generic
+// entry point such as syscall.Syscall: for the syscall wrappers, e.g.
+// syscall.read or golang.org/x/sys/unix.read, it is the lower-case
+// function name, "read"; otherwise it is the full function name.
+func syscallName(stk []*trace.Frame) string {
+	for _, f := range stk {
+		if strings.HasPrefix(f.Fn, "runtime.") {
+			continue
+		}
+		pkg := ""
+		for _, p := range syscallPackages {
+			if strings.HasPrefix(f.Fn, p) {
+				pkg = p
+				break
+			}
+		}
+		if pkg == "" {
+			return f.Fn
+		}
+		name := strings.ToLower(strings.TrimPrefix(f.Fn, pkg))
+		if strings.ContainsAny(name, "(.") {
+			continue // a method, such as syscall.(*Proc).Call.
+		}
+		if strings.HasPrefix(name, "syscall") || strings.HasPrefix(name, "rawsyscall") || strings.HasPrefix(name, "rawvforksyscall") {
+			continue // a generic entry point.
+		}
+		return name
+	}
+	return ""
+}
+
+// syscallPackages are the prefixes of the functions of the packages
+// wrapping syscalls in functions named after them.
+var syscallPackages = []string{"syscall.", "golang.org/x/sys/unix.", "internal/syscall/unix."}
+
+// pprofSchedRecords adds to prof the records of scheduler latency pprof-like profile
+// (time between a goroutine become runnable and actually scheduled for execution).
+// The latency is attributed to the stack where the goroutine became runnable:
+// the stack of the goroutine that unblocked it, or the stack of the go statement
+// that created it. As the latter is the stack of the parent goroutine, samples
+// are labeled with the reason "unblock" or "create" to tell them apart.
+// With the waker option, they are also labeled with the waker of the goroutine,
+// and with the idleP option, with whether a P was idle during the wait, as
+// idlep=yes or idlep=no.
+func pprofSchedRecords(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+	var idle idlePTimeline
+	if prof.opts.idleP {
+		idle = newIdlePTimeline(events)
+	}
+	for i, ev := range events {
+		if err := prof.checkCanceled(i); err != nil {
+			return err
+		}
+		var reason string
+		switch ev.Type {
+		case trace.EvGoUnblock:
+			reason = "unblock"
+		case trace.EvGoCreate:
+			reason = "create"
+		default:
+			continue
+		}
+		if ev.Link == nil {
+			continue
+		}
+		overlapping := prof.overlappingDuration(gToIntervals, ev)
+		if overlapping <= 0 {
+			continue
+		}
+		stkID, stk := ev.StkID, ev.Stk
+		var labels []string
+		if prof.opts.waker {
+			var waker string
+			waker, stkID, stk = schedWaker(ev)
+			labels = append(labels, "waker="+waker)
+		}
+		if prof.opts.idleP {
+			if idle.during(ev.Ts, ev.Link.Ts) {
+				labels = append(labels, "idlep=yes")
+			} else {
+				labels = append(labels, "idlep=no")
+			}
+		}
+		prof.addLabels(ev, stkID, stk, overlapping, reason, strings.Join(labels, "\n"))
+	}
+	return nil
+}
+
+// idlePTimeline lists the times some P became idle or all Ps became busy,
+// alternately, in order.
+type idlePTimeline []idlePChange
+
+type idlePChange struct {
+	ts   int64
+	idle bool // whether some P is idle from ts on.
+}
+
+// newIdlePTimeline returns the timeline of idle Ps of the trace, from the
+// EvGomaxprocs, EvProcStart and EvProcStop events, which must all be in events.
+// A P is idle when fewer Ps are started than GOMAXPROCS.
+func newIdlePTimeline(events []*trace.Event) idlePTimeline {
+	var tl idlePTimeline
+	running := make(map[int]bool) // started Ps
+	maxprocs := 0
+	idle := false
+	for _, ev := range events {
+		switch ev.Type {
+		case trace.EvGomaxprocs:
+			maxprocs = int(ev.Args[0])
+		case trace.EvProcStart:
+			running[ev.P] = true
+		case trace.EvProcStop:
+			delete(running, ev.P)
 		default:
 			continue
 		}
-		if ev.Link == nil || ev.StkID == 0 || len(ev.Stk) == 0 {
-			continue
+		if now := len(running) < maxprocs; now != idle {
+			idle = now
+			tl = append(tl, idlePChange{ev.Ts, idle})
+		}
+	}
+	return tl
+}
+
+// during reports whether some P was idle at some time from begin to end.
+func (tl idlePTimeline) during(begin, end int64) bool {
+	i := sort.Search(len(tl), func(i int) bool { return tl[i].ts > begin })
+	if i > 0 && tl[i-1].idle {
+		return true // idle at begin.
+	}
+	// Otherwise, the next change, if any, makes a P idle.
+	return i < len(tl) && tl[i].ts < end
+}
+
+// schedWaker returns the waker of the goroutine made runnable by the event ev,
+// for the waker option of the scheduler latency profile, and the stack to
+// attribute the latency to. The waker is the network poller, a timer or the
+// return from a syscall, as told by the fake P of the event, or else the
+// innermost function of the stack of the event outside the runtime. Events
+// without a stack are attributed to a single frame naming their waker, the
+// scheduler if no other, rather than dropped.
+func schedWaker(ev *trace.Event) (waker string, stkID uint64, stk []*trace.Frame) {
+	switch ev.P {
+	case trace.NetpollP:
+		waker = "network poller"
+	case trace.TimerP:
+		waker = "timer"
+	case trace.SyscallP:
+		waker = "syscall"
+	}
+	if ev.StkID != 0 && len(ev.Stk) > 0 {
+		if waker == "" {
+			waker = ev.Stk[0].Fn
+			for _, f := range ev.Stk {
+				if !strings.HasPrefix(f.Fn, "runtime.") {
+					waker = f.Fn
+					break
+				}
+			}
+		}
+		return waker, ev.StkID, ev.Stk
+	}
+	pc := uint64(ev.P) // the fake P, which no stack id or PC is likely to match.
+	if waker == "" {
+		waker, pc = "scheduler", trace.FakeP
+	}
+	return waker, pc, []*trace.Frame{{PC: pc, Fn: "[" + waker + "]"}}
+}
+
+// pprofExecRecords adds to prof the records of execution pprof-like profile
+// (time goroutines spent running on a P).
+func pprofExecRecords(prof *pprofRecords, gToIntervals map[uint64][]interval, events []*trace.Event) error {
+	for i, ev := range events {
+		if err := prof.checkCanceled(i); err != nil {
+			return err
+		}
+		if ev.Type != trace.EvGoStart && ev.Type != trace.EvGoStartLabel {
+			continue
+		}
+		// GoStart events carry a stack only for the first start of a goroutine
+		// (its start function), so attribute the execution time to the stack
+		// where the goroutine stopped running, if recorded.
+		stkID, stk := ev.StkID, ev.Stk
+		if ev.Link != nil && ev.Link.StkID != 0 && len(ev.Link.Stk) != 0 {
+			stkID, stk = ev.Link.StkID, ev.Link.Stk
+		}
+		overlapping := prof.overlappingDuration(gToIntervals, ev)
+		if overlapping > 0 {
+			prof.add(ev, stkID, stk, overlapping)
+		}
+	}
+	return nil
+}
+
+// mergeGoroutineIntervals returns a copy of gToIntervals in which the
+// intervals of each goroutine are merged into a sorted list of
+// non-overlapping intervals, so that pprofOverlappingDuration never
+// counts the same period of time twice.
+func mergeGoroutineIntervals(gToIntervals map[uint64][]interval) map[uint64][]interval {
+	if gToIntervals == nil {
+		return nil
+	}
+	res := make(map[uint64][]interval, len(gToIntervals))
+	for g, intervals := range gToIntervals {
+		res[g] = mergeIntervals(intervals)
+	}
+	return res
+}
+
+// mergeIntervals returns the union of the intervals
+// as a sorted list of non-overlapping intervals.
+func mergeIntervals(intervals []interval) []interval {
+	if len(intervals) < 2 {
+		return intervals
+	}
+	sorted := append([]interval(nil), intervals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].begin < sorted[j].begin })
+	res := sorted[:1]
+	for _, i := range sorted[1:] {
+		last := &res[len(res)-1]
+		if i.begin <= last.end { // overlapping; extend the last interval.
+			if last.end < i.end {
+				last.end = i.end
+			}
+			continue
+		}
+		res = append(res, i)
+	}
+	return res
+}
+
+// pprofOverlappingDuration returns the overlapping duration between
+// the time intervals in gToIntervals and the specified event.
+// The intervals of each goroutine should not overlap each other
+// (see mergeGoroutineIntervals), or the time in the overlapping
+// parts is counted several times.
+// If gToIntervals is nil, this simply returns the event's duration.
+// If the event has no linked event (e.g. a goroutine still running
+// at the end of the trace), the event is assumed to last until the
+// end of its trace, as given by traceEnd.
+func pprofOverlappingDuration(gToIntervals map[uint64][]interval, ev *trace.Event) time.Duration {
+	var end int64
+	if ev.Link != nil {
+		end = ev.Link.Ts
+	} else {
+		end = traceEnd(ev.Ts)
+	}
+	if end < ev.Ts {
+		return 0 // the clocks of the Ps are skewed.
+	}
+	if gToIntervals == nil { // No filtering.
+		return time.Duration(end-ev.Ts) * time.Nanosecond
+	}
+	intervals := gToIntervals[ev.G]
+	if len(intervals) == 0 {
+		return 0
+	}
+
+	var overlapping time.Duration
+	for _, i := range intervals {
+		if o := overlappingDuration(i.begin, i.end, ev.Ts, end); o > 0 {
+			overlapping += o
+		}
+	}
+	return overlapping
+}
+
+// overlappingDuration is like pprofOverlappingDuration,
+// but also counts the events that end before they start.
+func (prof *pprofRecords) overlappingDuration(gToIntervals map[uint64][]interval, ev *trace.Event) time.Duration {
+	if ev.Link != nil && ev.Link.Ts < ev.Ts {
+		prof.skewed++
+		return 0
+	}
+	return pprofOverlappingDuration(gToIntervals, ev)
+}
+
+// serveSVGProfile serves pprof-like profile generated by prof as svg.
+func serveSVGProfile(prof func(w io.Writer, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.FormValue("raw") != "" {
+			// The trace does not change, so the profile for the same
+			// request is the same as long as the trace files are.
+			modTime, etag := rawProfileValidators(r)
+			if etag != "" {
+				w.Header().Set("ETag", etag)
+				if r.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			// The profile is already gzip-compressed protobuf, so serve it
+			// as-is (without Content-Encoding) under a name pprof accepts.
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(r.URL.Path)+".pb.gz"))
+			var buf bytes.Buffer
+			if err := prof(&buf, r); err != nil {
+				w.Header().Del("Content-Disposition")
+				w.Header().Del("ETag")
+				if _, ok := err.(*emptyProfileError); ok {
+					w.Header().Set("X-Go-Trace-Empty-Profile", err.Error())
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Header().Set("X-Go-Pprof", "1")
+				serveProfileError(w, err)
+				return
+			}
+			// ServeContent sets Content-Length and handles If-Modified-Since.
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(buf.Bytes()))
+			return
+		}
+
+		switch format := r.FormValue("format"); format {
+		case "", "svg":
+		case "text":
+			p, err := generateProfile(prof, r)
+			if err != nil {
+				serveProfileError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			if err := writeTextProfile(w, p); err != nil {
+				http.Error(w, fmt.Sprintf("failed to write profile: %v", err), http.StatusInternalServerError)
+			}
+			return
+		case "json":
+			p, err := generateProfile(prof, r)
+			if err != nil {
+				serveProfileError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := writeJSONProfile(w, p); err != nil {
+				http.Error(w, fmt.Sprintf("failed to write profile: %v", err), http.StatusInternalServerError)
+			}
+			return
+		case "raw-text":
+			// The samples, locations and labels of the profile as generated,
+			// for debugging the profile generation itself.
+			p, err := generateProfile(prof, r)
+			if err != nil {
+				serveProfileError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, p.String())
+			return
+		case "csv":
+			p, err := generateProfile(prof, r)
+			if err != nil {
+				serveProfileError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			if err := writeCSVProfile(w, p); err != nil {
+				http.Error(w, fmt.Sprintf("failed to write profile: %v", err), http.StatusInternalServerError)
+			}
+			return
+		case "callgrind":
+			p, err := generateProfile(prof, r)
+			if err != nil {
+				serveProfileError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			if err := writeCallgrindProfile(w, p); err != nil {
+				http.Error(w, fmt.Sprintf("failed to write profile: %v", err), http.StatusInternalServerError)
+			}
+			return
+		case "flamegraph":
+			p, err := generateProfile(prof, r)
+			if err != nil {
+				serveProfileError(w, err)
+				return
+			}
+			// Fall back to the svg if the pprof web interface cannot start.
+			if ui, err := startPprofUI(p); err == nil {
+				http.Redirect(w, r, ui, http.StatusFound)
+				return
+			}
+		default:
+			http.Error(w, fmt.Sprintf("unknown format: %v", format), http.StatusBadRequest)
+			return
+		}
+
+		// The trace does not change, so neither do the profiles
+		// rendered for the same request parameters.
+		key := r.URL.Path + "?" + r.Form.Encode()
+		if svg, ok := svgCache.get(key); ok {
+			serveSVG(w, r, svg)
+			return
+		}
+		flags, err := pprofGraphFlags(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var buf bytes.Buffer
+		if err := prof(&buf, r); err != nil {
+			serveProfileError(w, err)
+			return
 		}
-		overlapping := pprofOverlappingDuration(gToIntervals, ev)
-		if overlapping > 0 {
-			rec := prof[ev.StkID]
-			rec.stk = ev.Stk
-			rec.n++
-			rec.time += overlapping.Nanoseconds()
-			prof[ev.StkID] = rec
+		// The rendering is canceled along with the request.
+		ctx, cancel := context.WithTimeout(r.Context(), *pprofTimeoutFlag)
+		defer cancel()
+		svg, err := renderSVG(ctx, buf.Bytes(), flags)
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				http.Error(w, fmt.Sprintf("pprof did not finish within %v; see the -pprof-timeout flag", *pprofTimeoutFlag), http.StatusGatewayTimeout)
+				return
+			}
+			if e, ok := err.(*pprofExecError); ok && pprofUnavailable(e.err, e.stderr) {
+				serveTextProfileFallback(w, r, buf.Bytes(), e.err)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+		svgCache.add(key, svg)
+		serveSVG(w, r, svg)
 	}
-	return buildProfile(prof).Write(w)
 }
 
-// computePprofSyscall generates syscall pprof-like profile (time spent blocked in syscalls).
-func computePprofSyscall(w io.Writer, gToIntervals map[uint64][]interval, events []*trace.Event) error {
-	prof := make(map[uint64]Record)
-	for _, ev := range events {
-		if ev.Type != trace.EvGoSysCall || ev.Link == nil || ev.StkID == 0 || len(ev.Stk) == 0 {
+// renderSVG renders the profile, in the protobuf format, as svg with pprof,
+// passing it the graph flags. go tool pprof cannot read the profile from its
+// standard input (it reopens the named file to detect its format), so the
+// profile goes through a temp file, but the svg is read from its output.
+// The command is killed if it hangs, e.g. waiting on the dot command, until
+// ctx is done. The failure of the command is a *pprofExecError.
+func renderSVG(ctx context.Context, prof []byte, flags []string) ([]byte, error) {
+	f, err := ioutil.TempFile("", "block")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(prof)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write temp file: %v", err)
+	}
+	var svg, stderr bytes.Buffer
+	args := append([]string{"-svg"}, flags...)
+	cmd := pprofCommand(ctx, append(args, f.Name())...)
+	cmd.Stdout = &svg
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, &pprofExecError{err: err, stderr: stderr.Bytes()}
+	}
+	return svg.Bytes(), nil
+}
+
+// pprofExecError is the failure of pprof to render a profile.
+type pprofExecError struct {
+	err    error
+	stderr []byte // output of pprof.
+}
+
+func (e *pprofExecError) Error() string {
+	return fmt.Sprintf("failed to execute pprof: %v\n%s", e.err, e.stderr)
+}
+
+// serveSVG writes the svg of a profile, gzipped if the client accepts it,
+// as the svgs of large profiles are big but compress well.
+func serveSVG(w http.ResponseWriter, r *http.Request, svg []byte) {
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		w.Write(svg)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	gz.Write(svg)
+	gz.Close()
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r accepts gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		elems := strings.Split(v, ";")
+		if strings.TrimSpace(elems[0]) != "gzip" {
 			continue
 		}
-		overlapping := pprofOverlappingDuration(gToIntervals, ev)
-		if overlapping > 0 {
-			rec := prof[ev.StkID]
-			rec.stk = ev.Stk
-			rec.n++
-			rec.time += overlapping.Nanoseconds()
-			prof[ev.StkID] = rec
+		for _, param := range elems[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[len("q="):], 64); err == nil && q == 0 {
+				return false // explicitly not acceptable.
+			}
 		}
+		return true
 	}
-	return buildProfile(prof).Write(w)
+	return false
 }
 
-// computePprofSched generates scheduler latency pprof-like profile
-// (time between a goroutine become runnable and actually scheduled for execution).
-func computePprofSched(w io.Writer, gToIntervals map[uint64][]interval, events []*trace.Event) error {
-	prof := make(map[uint64]Record)
-	for _, ev := range events {
-		if (ev.Type != trace.EvGoUnblock && ev.Type != trace.EvGoCreate) ||
-			ev.Link == nil || ev.StkID == 0 || len(ev.Stk) == 0 {
-			continue
+// rawProfileValidators returns the modification time of the trace files and
+// an entity tag identifying the raw profile served for the request r, derived
+// from the trace files and the request parameters. If the trace was not read
+// from files, it returns the zero time and an empty entity tag.
+func rawProfileValidators(r *http.Request) (modTime time.Time, etag string) {
+	h := sha256.New()
+	for _, name := range traceFileNames() {
+		fi, err := os.Stat(name)
+		if err != nil || !fi.Mode().IsRegular() {
+			return time.Time{}, ""
 		}
-		overlapping := pprofOverlappingDuration(gToIntervals, ev)
-		if overlapping > 0 {
-			rec := prof[ev.StkID]
-			rec.stk = ev.Stk
-			rec.n++
-			rec.time += overlapping.Nanoseconds()
-			prof[ev.StkID] = rec
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
 		}
+		fmt.Fprintf(h, "%s %d %d\n", name, fi.Size(), fi.ModTime().UnixNano())
 	}
-	return buildProfile(prof).Write(w)
+	fmt.Fprintf(h, "%s?%s", r.URL.Path, r.Form.Encode())
+	return modTime, fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
 }
 
-// pprofOverlappingDuration returns the overlapping duration between
-// the time intervals in gToIntervals and the specified event.
-// If gToIntervals is nil, this simply returns the event's duration.
-func pprofOverlappingDuration(gToIntervals map[uint64][]interval, ev *trace.Event) time.Duration {
-	if gToIntervals == nil { // No filtering.
-		return time.Duration(ev.Link.Ts-ev.Ts) * time.Nanosecond
+// svgCache holds the most recently rendered svg profiles,
+// keyed by the request path and parameters.
+var svgCache = newLRUCache(16)
+
+// lruCache is a cache of byte slices bounded to a maximum number of entries,
+// which evicts the least recently used entry when full.
+type lruCache struct {
+	mu      sync.Mutex
+	max     int
+	ll      *list.List // of *lruEntry, from the most recently used.
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	data []byte
+}
+
+func newLRUCache(max int) *lruCache {
+	return &lruCache{max: max, ll: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the data cached for key, if any.
+func (c *lruCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
 	}
-	intervals := gToIntervals[ev.G]
-	if len(intervals) == 0 {
-		return 0
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry).data, true
+}
+
+// add caches data for key, evicting the least recently used entry if needed.
+func (c *lruCache) add(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry).data = data
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.ll.PushFront(&lruEntry{key, data})
+	if c.ll.Len() > c.max {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.entries, e.Value.(*lruEntry).key)
 	}
+}
 
-	var overlapping time.Duration
-	for _, i := range intervals {
-		if o := overlappingDuration(i.begin, i.end, ev.Ts, ev.Link.Ts); o > 0 {
-			overlapping += o
+// pprofCommand returns the command running pprof with the arguments args:
+// the pprof binary given by the -pprof-bin flag, if any, or go tool pprof.
+func pprofCommand(ctx context.Context, args ...string) *exec.Cmd {
+	if *pprofBinFlag != "" {
+		return exec.CommandContext(ctx, *pprofBinFlag, args...)
+	}
+	return exec.CommandContext(ctx, goCmd(), append([]string{"tool", "pprof"}, args...)...)
+}
+
+// pprofGraphFlags returns the go tool pprof flags for the focus and ignore
+// request parameters, after checking they are valid regular expressions,
+// and for the value parameter, which selects the sample value the graph is
+// weighted by: "count" for the number of events or "delay" (the default).
+// The nodecount and nodefraction parameters, which prune the graph to its
+// main nodes, are passed on after checking they are numbers.
+// The hide parameter needs no flag: buildProfile already removes the frames.
+func pprofGraphFlags(r *http.Request) ([]string, error) {
+	var flags []string
+	switch v := r.FormValue("value"); v {
+	case "", "delay":
+		// The default sample type of the profiles.
+	case "count":
+		flags = append(flags, "-sample_index=0")
+	case "avgdelay":
+		if r.FormValue("avg") != "1" {
+			return nil, fmt.Errorf("value=avgdelay requires avg=1")
 		}
+		flags = append(flags, "-sample_index=avgdelay")
+	default:
+		return nil, fmt.Errorf("invalid value parameter: %v", v)
 	}
-	return overlapping
+	for _, name := range []string{"focus", "ignore"} {
+		v := r.FormValue(name)
+		if v == "" {
+			continue
+		}
+		if _, err := regexp.Compile(v); err != nil {
+			return nil, fmt.Errorf("invalid %s parameter: %v", name, err)
+		}
+		flags = append(flags, "-"+name+"="+v)
+	}
+	if v := r.FormValue("nodecount"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid nodecount parameter: %v", v)
+		}
+		flags = append(flags, "-nodecount="+v)
+	}
+	if v := r.FormValue("nodefraction"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err != nil || f < 0 || f > 1 {
+			return nil, fmt.Errorf("invalid nodefraction parameter: %v", v)
+		}
+		flags = append(flags, "-nodefraction="+v)
+	}
+	return flags, nil
 }
 
-// serveSVGProfile serves pprof-like profile generated by prof as svg.
-func serveSVGProfile(prof func(w io.Writer, r *http.Request) error) http.HandlerFunc {
+// zipProfileKinds are the kinds of the profiles served together by serveProfilesZip.
+var zipProfileKinds = []profileKind{profileIO, profileBlock, profileSyscall, profileSched}
+
+// serveIntervals serves the goroutine intervals selected by the request
+// parameters of a profile, as written by writeIntervals. It helps to tell
+// why a profile is empty. Errors are reported as for the profile.
+func serveIntervals(intervals func(w io.Writer, r *http.Request) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := intervals(&buf, r); err != nil {
+			serveProfileError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		buf.WriteTo(w)
+	}
+}
 
-		if r.FormValue("raw") != "" {
-			w.Header().Set("Content-Type", "application/octet-stream")
-			if err := prof(w, r); err != nil {
-				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-				w.Header().Set("X-Go-Pprof", "1")
-				http.Error(w, fmt.Sprintf("failed to get profile: %v", err), http.StatusInternalServerError)
-				return
+// writeIntervals writes gToIntervals as JSON, mapping each goroutine id to
+// its intervals in nanoseconds since the trace start. If gToIntervals is
+// nil, the profile is not restricted to any goroutines, which is reported
+// as "all": true.
+func writeIntervals(w io.Writer, gToIntervals map[uint64][]interval, events []*trace.Event, opts *pprofOptions) error {
+	type jsonInterval struct {
+		Begin int64 `json:"begin"`
+		End   int64 `json:"end"`
+	}
+	res := struct {
+		All        bool                      `json:"all"`
+		Goroutines map[string][]jsonInterval `json:"goroutines"`
+	}{
+		All:        gToIntervals == nil,
+		Goroutines: make(map[string][]jsonInterval),
+	}
+	for g, intervals := range gToIntervals {
+		list := make([]jsonInterval, 0, len(intervals))
+		for _, iv := range intervals {
+			list = append(list, jsonInterval{iv.begin, iv.end})
+		}
+		res.Goroutines[strconv.FormatUint(g, 10)] = list
+	}
+	return json.NewEncoder(w).Encode(res)
+}
+
+// serveProfilesZip serves a zip file of the raw profiles of zipProfileKinds,
+// named <kind>.pb.gz, restricted by the request parameters as each profile
+// would be. The archive is streamed as the profiles are computed, so a
+// profile that fails, such as for lack of samples, is replaced by the
+// error, in <kind>.error.txt, rather than failing the request.
+func serveProfilesZip(w http.ResponseWriter, r *http.Request) {
+	var zw *zip.Writer
+	err := pprofByGoroutine(func(_ io.Writer, gToIntervals map[uint64][]interval, events []*trace.Event, opts *pprofOptions) error {
+		// The request parameters are valid: start the archive.
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="profiles.zip"`)
+		zw = zip.NewWriter(w)
+		for _, kind := range zipProfileKinds {
+			var buf bytes.Buffer
+			// The profiles are already compressed.
+			fh := &zip.FileHeader{Name: kind.String() + ".pb.gz", Method: zip.Store}
+			if err := computePprof(&buf, kind, gToIntervals, events, opts); err != nil {
+				buf.Reset()
+				fmt.Fprintln(&buf, err)
+				fh = &zip.FileHeader{Name: kind.String() + ".error.txt", Method: zip.Deflate}
+			}
+			f, err := zw.CreateHeader(fh)
+			if err != nil {
+				return err
+			}
+			if _, err := buf.WriteTo(f); err != nil {
+				return err
 			}
-			return
 		}
+		return zw.Close()
+	})(nil, r)
+	if err != nil && zw == nil {
+		serveProfileError(w, err)
+	}
+	// Otherwise, the archive is partly written: the client
+	// gets a truncated zip file, as the status is already sent.
+}
 
-		blockf, err := ioutil.TempFile("", "block")
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to create temp file: %v", err), http.StatusInternalServerError)
-			return
+// serveProfileError reports the failure to generate a profile.
+func serveProfileError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *emptyProfileError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case *spanFilterError, *paramError:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, fmt.Sprintf("failed to generate profile: %v", err), http.StatusInternalServerError)
+}
+
+// pprofUnavailable reports whether the failure of running go tool pprof
+// indicates that the go command or its pprof tool is not installed.
+func pprofUnavailable(err error, output []byte) bool {
+	if _, ok := err.(*exec.Error); ok {
+		return true // the go command was not found in $PATH.
+	}
+	if os.IsNotExist(err) {
+		return true // the go command or pprof binary given by path does not exist.
+	}
+	return bytes.Contains(output, []byte("no such tool"))
+}
+
+// serveTextProfileFallback serves the profile, in the protobuf format, as
+// a text report, along with instructions for rendering the graph manually.
+// It is used when go tool pprof is not available.
+func serveTextProfileFallback(w http.ResponseWriter, r *http.Request, prof []byte, pprofErr error) {
+	p, err := profile.Parse(bytes.NewReader(prof))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	u := *r.URL
+	q := u.Query()
+	q.Set("raw", "1")
+	u.RawQuery = q.Encode()
+	name := path.Base(r.URL.Path) + ".pb.gz"
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "go tool pprof is not available (%v), showing a text report instead.\n", pprofErr)
+	fmt.Fprintf(w, "To view the graph, download the profile and run pprof yourself:\n")
+	fmt.Fprintf(w, "\tcurl -o %s 'http://%s%s'\n", name, r.Host, u.RequestURI())
+	fmt.Fprintf(w, "\tgo tool pprof -http=:0 %s\n\n", name)
+	if err := writeTextProfile(w, p); err != nil {
+		fmt.Fprintf(w, "failed to write profile: %v\n", err)
+	}
+}
+
+// generateProfile runs prof for the request and returns the generated profile.
+func generateProfile(prof func(w io.Writer, r *http.Request) error, r *http.Request) (*profile.Profile, error) {
+	var buf bytes.Buffer
+	if err := prof(&buf, r); err != nil {
+		return nil, err
+	}
+	return profile.Parse(&buf)
+}
+
+// jsonProfile is the JSON representation of a profile, with flattened samples.
+type jsonProfile struct {
+	Unit     string       `json:"unit"` // unit of the delay values.
+	Comments []string     `json:"comments,omitempty"`
+	Samples  []jsonSample `json:"samples"`
+}
+
+type jsonSample struct {
+	Stack []jsonFrame `json:"stack"` // from the innermost frame.
+	Count int64       `json:"count"`
+	Delay int64       `json:"delay"`
+}
+
+type jsonFrame struct {
+	Func string `json:"func"`
+	File string `json:"file"`
+	Line int64  `json:"line"`
+}
+
+// writeJSONProfile writes the samples of the profile p to w as JSON,
+// for consumers that do not parse the pprof protobuf format.
+func writeJSONProfile(w io.Writer, p *profile.Profile) error {
+	idx := defaultSampleIndex(p)
+	jp := jsonProfile{
+		Unit:     p.SampleType[idx].Unit,
+		Comments: p.Comments,
+		Samples:  make([]jsonSample, 0, len(p.Sample)),
+	}
+	for _, s := range p.Sample {
+		js := jsonSample{Count: s.Value[0], Delay: s.Value[idx]}
+		for _, loc := range s.Location {
+			for _, line := range loc.Line {
+				js.Stack = append(js.Stack, jsonFrame{
+					Func: line.Function.Name,
+					File: line.Function.Filename,
+					Line: line.Line,
+				})
+			}
 		}
-		defer func() {
-			blockf.Close()
-			os.Remove(blockf.Name())
-		}()
-		blockb := bufio.NewWriter(blockf)
-		if err := prof(blockb, r); err != nil {
-			http.Error(w, fmt.Sprintf("failed to generate profile: %v", err), http.StatusInternalServerError)
-			return
+		jp.Samples = append(jp.Samples, js)
+	}
+	return json.NewEncoder(w).Encode(jp)
+}
+
+// defaultSampleIndex returns the index of the default sample type of p,
+// the delay or the value of other kinds of profiles.
+func defaultSampleIndex(p *profile.Profile) int {
+	for i, st := range p.SampleType {
+		if st.Type == p.DefaultSampleType {
+			return i
 		}
-		if err := blockb.Flush(); err != nil {
-			http.Error(w, fmt.Sprintf("failed to flush temp file: %v", err), http.StatusInternalServerError)
-			return
+	}
+	return len(p.SampleType) - 1
+}
+
+// writeTextProfile writes a flat, top-like report of the delay in
+// the profile p to w, listing functions by decreasing flat delay.
+// It does not require the pprof tool.
+func writeTextProfile(w io.Writer, p *profile.Profile) error {
+	idx := defaultSampleIndex(p)
+	format := func(v int64) string {
+		for _, u := range delayUnits {
+			if p.SampleType[idx].Unit == u.name {
+				return (time.Duration(v) * u.d).String()
+			}
 		}
-		if err := blockf.Close(); err != nil {
-			http.Error(w, fmt.Sprintf("failed to close temp file: %v", err), http.StatusInternalServerError)
-			return
+		return strconv.FormatInt(v, 10)
+	}
+	type entry struct {
+		name      string
+		flat, cum int64
+	}
+	entries := make(map[string]*entry)
+	var total int64
+	for _, s := range p.Sample {
+		v := s.Value[idx]
+		total += v
+		seen := make(map[string]bool) // count cum once per sample, e.g. for recursive calls.
+		for i, loc := range s.Location {
+			for j, line := range loc.Line {
+				name := line.Function.Name
+				e := entries[name]
+				if e == nil {
+					e = &entry{name: name}
+					entries[name] = e
+				}
+				if i == 0 && j == 0 { // leaf frame
+					e.flat += v
+				}
+				if !seen[name] {
+					seen[name] = true
+					e.cum += v
+				}
+			}
 		}
-		svgFilename := blockf.Name() + ".svg"
-		if output, err := exec.Command(goCmd(), "tool", "pprof", "-svg", "-output", svgFilename, blockf.Name()).CombinedOutput(); err != nil {
-			http.Error(w, fmt.Sprintf("failed to execute go tool pprof: %v\n%s", err, output), http.StatusInternalServerError)
-			return
+	}
+	list := make([]*entry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].flat != list[j].flat {
+			return list[i].flat > list[j].flat
+		}
+		if list[i].cum != list[j].cum {
+			return list[i].cum > list[j].cum
+		}
+		return list[i].name < list[j].name
+	})
+
+	percent := func(v int64) string {
+		if total == 0 {
+			return "0%"
+		}
+		return fmt.Sprintf("%.2f%%", float64(v)/float64(total)*100)
+	}
+	for _, c := range p.Comments {
+		if strings.HasPrefix(c, summaryPrefix) {
+			fmt.Fprintf(w, "Event durations: %s\n", strings.TrimPrefix(c, summaryPrefix))
+		}
+		if strings.HasPrefix(c, droppedPrefix) {
+			fmt.Fprintf(w, "Dropped: %s\n", strings.TrimPrefix(c, droppedPrefix))
+		}
+		if strings.HasPrefix(c, skewedPrefix) {
+			fmt.Fprintf(w, "Skewed: %s\n", strings.TrimPrefix(c, skewedPrefix))
+		}
+	}
+	fmt.Fprintf(w, "Showing %d samples, total %s %s\n", len(p.Sample), p.SampleType[idx].Type, format(total))
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "flat\tflat%%\tsum%%\tcum\tcum%%\t\n")
+	var sum int64
+	for _, e := range list {
+		sum += e.flat
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t %s\n", format(e.flat), percent(e.flat), percent(sum), format(e.cum), percent(e.cum), e.name)
+	}
+	return tw.Flush()
+}
+
+// writeCSVProfile writes the samples of the profile p to w as CSV, one row
+// per sample with its innermost function, a hash identifying its stack,
+// its count and its delay, for spreadsheets and data frames.
+func writeCSVProfile(w io.Writer, p *profile.Profile) error {
+	idx := defaultSampleIndex(p)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"leaf", "stack", p.SampleType[0].Type, p.SampleType[idx].Type + "_" + p.SampleType[idx].Unit})
+	for _, s := range p.Sample {
+		var leaf string
+		h := fnv.New64a()
+		for _, loc := range s.Location {
+			for _, line := range loc.Line {
+				if leaf == "" {
+					leaf = line.Function.Name
+				}
+				fmt.Fprintf(h, "%s %s:%d\n", line.Function.Name, line.Function.Filename, line.Line)
+			}
 		}
-		defer os.Remove(svgFilename)
-		w.Header().Set("Content-Type", "image/svg+xml")
-		http.ServeFile(w, r, svgFilename)
+		cw.Write([]string{leaf, fmt.Sprintf("%016x", h.Sum64()), strconv.FormatInt(s.Value[0], 10), strconv.FormatInt(s.Value[idx], 10)})
 	}
+	cw.Flush()
+	return cw.Error()
 }
 
-func buildProfile(prof map[uint64]Record) *profile.Profile {
+// writeCallgrindProfile writes the profile p to w in the callgrind format,
+// for KCachegrind and the other callgrind viewers. The cost is the delay, or
+// the value of other kinds of profiles: each sample adds its value to the self
+// cost of its innermost frame and to the inclusive cost of each call of its stack.
+func writeCallgrindProfile(w io.Writer, p *profile.Profile) error {
+	idx := defaultSampleIndex(p)
+	type fnKey struct {
+		name, file string
+	}
+	type callKey struct {
+		callee           fnKey
+		line, calleeLine int64
+	}
+	type callCost struct {
+		calls, cost int64
+	}
+	type fnCosts struct {
+		self  map[int64]int64 // line to self cost
+		calls map[callKey]*callCost
+	}
+	fns := make(map[fnKey]*fnCosts)
+	costsOf := func(line profile.Line) (fnKey, *fnCosts) {
+		k := fnKey{name: line.Function.Name, file: line.Function.Filename}
+		if k.file == "" {
+			k.file = "???" // as valgrind names unknown files.
+		}
+		c := fns[k]
+		if c == nil {
+			c = &fnCosts{self: make(map[int64]int64), calls: make(map[callKey]*callCost)}
+			fns[k] = c
+		}
+		return k, c
+	}
+	var total int64
+	for _, s := range p.Sample {
+		v := s.Value[idx]
+		var frames []profile.Line // from the innermost frame.
+		for _, loc := range s.Location {
+			frames = append(frames, loc.Line...)
+		}
+		if len(frames) == 0 {
+			continue
+		}
+		total += v
+		_, leaf := costsOf(frames[0])
+		leaf.self[frames[0].Line] += v
+		for i := 1; i < len(frames); i++ {
+			callee, _ := costsOf(frames[i-1])
+			_, caller := costsOf(frames[i])
+			k := callKey{callee: callee, line: frames[i].Line, calleeLine: frames[i-1].Line}
+			c := caller.calls[k]
+			if c == nil {
+				c = new(callCost)
+				caller.calls[k] = c
+			}
+			c.calls += s.Value[0]
+			c.cost += v
+		}
+	}
+
+	keys := make([]fnKey, 0, len(fns))
+	for k := range fns {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].file < keys[j].file
+	})
+	// Names are compressed: only their first occurrence is written in
+	// full after its id, and the later ones are written as the id alone.
+	fileIDs := make(map[string]int)
+	fnIDs := make(map[string]int)
+	compressed := func(ids map[string]int, name string) string {
+		if id, ok := ids[name]; ok {
+			return fmt.Sprintf("(%d)", id)
+		}
+		ids[name] = len(ids) + 1
+		return fmt.Sprintf("(%d) %s", ids[name], name)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# callgrind format\n")
+	for _, c := range p.Comments {
+		fmt.Fprintf(bw, "# %s\n", c)
+	}
+	fmt.Fprintf(bw, "version: 1\ncreator: go tool trace\npositions: line\n")
+	fmt.Fprintf(bw, "event: %s : %s (%s)\n", p.SampleType[idx].Type, p.SampleType[idx].Type, p.SampleType[idx].Unit)
+	fmt.Fprintf(bw, "events: %s\nsummary: %d\n", p.SampleType[idx].Type, total)
+	for _, k := range keys {
+		c := fns[k]
+		fmt.Fprintf(bw, "\nfl=%s\nfn=%s\n", compressed(fileIDs, k.file), compressed(fnIDs, k.name))
+		lines := make([]int64, 0, len(c.self))
+		for line := range c.self {
+			lines = append(lines, line)
+		}
+		sort.Slice(lines, func(i, j int) bool { return lines[i] < lines[j] })
+		for _, line := range lines {
+			fmt.Fprintf(bw, "%d %d\n", line, c.self[line])
+		}
+		calls := make([]callKey, 0, len(c.calls))
+		for ck := range c.calls {
+			calls = append(calls, ck)
+		}
+		sort.Slice(calls, func(i, j int) bool {
+			a, b := calls[i], calls[j]
+			if a.line != b.line {
+				return a.line < b.line
+			}
+			if a.callee != b.callee {
+				return a.callee.name < b.callee.name || a.callee.name == b.callee.name && a.callee.file < b.callee.file
+			}
+			return a.calleeLine < b.calleeLine
+		})
+		for _, ck := range calls {
+			cc := c.calls[ck]
+			fmt.Fprintf(bw, "cfl=%s\ncfn=%s\ncalls=%d %d\n%d %d\n",
+				compressed(fileIDs, ck.callee.file), compressed(fnIDs, ck.callee.name),
+				cc.calls, ck.calleeLine, ck.line, cc.cost)
+		}
+	}
+	return bw.Flush()
+}
+
+func buildProfile(prof *pprofRecords) *profile.Profile {
+	unit := prof.opts.unit
+	if unit.d == 0 {
+		unit = delayUnits["ns"]
+	}
 	p := &profile.Profile{
 		PeriodType: &profile.ValueType{Type: "trace", Unit: "count"},
 		Period:     1,
 		SampleType: []*profile.ValueType{
 			{Type: "contentions", Unit: "count"},
-			{Type: "delay", Unit: "nanoseconds"},
+			{Type: "delay", Unit: unit.name},
+		},
+		DefaultSampleType: "delay",
+		DurationNanos:     lastTimestamp() - firstTimestamp(),
+		Comments: []string{
+			"trace: " + traceFile,
+			"kind: " + prof.kind,
+			"analyzed by go tool trace " + runtime.Version(),
 		},
 	}
-	locs := make(map[uint64]*profile.Location)
+	if prof.opts.avg {
+		// pprof sums the values of the samples it aggregates, so the
+		// average delay is per sample, that is per record, but not per node.
+		p.SampleType = append(p.SampleType, &profile.ValueType{Type: "avgdelay", Unit: unit.name})
+	}
+	if start, ok := traceStartTime(); ok {
+		p.TimeNanos = start.UnixNano()
+	}
+	// Traces do not record the binary, but it may be given on the command line,
+	// so that pprof can symbolize the locations against it.
+	var mapping *profile.Mapping
+	if programBinary != "" {
+		mapping = &profile.Mapping{
+			ID:      1,
+			Start:   0,
+			Limit:   math.MaxUint64,
+			File:    programBinary,
+			BuildID: programBuildID(),
+		}
+		p.Mapping = []*profile.Mapping{mapping}
+	}
+	// Locations are identified by PC or, with the mergeByFunc option,
+	// by their source lines, so that the same code at different PCs,
+	// such as differently inlined copies, makes a single location.
+	type locKey struct {
+		pc    uint64
+		lines string
+	}
+	locs := make(map[locKey]*profile.Location)
 	funcs := make(map[string]*profile.Function)
-	for _, rec := range prof {
+	// The records are visited in order, rather than in the random order of
+	// the map, so that the same trace and options give the same profile,
+	// byte for byte, with its samples, locations and functions in order.
+	keys := make([]recordKey, 0, len(prof.recs))
+	for key := range prof.recs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	for _, key := range keys {
+		rec := prof.recs[key]
+		if prof.opts.hide != nil {
+			rec.stk = hideFrames(rec.stk, prof.opts.hide)
+		}
+		if prof.opts.collapse {
+			rec.stk = collapseRecursion(rec.stk)
+		}
+		if prof.opts.maxDepth > 0 {
+			rec.stk = truncateStack(rec.stk, prof.opts.maxDepth)
+		}
 		var sloc []*profile.Location
-		for _, frame := range rec.stk {
-			loc := locs[frame.PC]
-			if loc == nil {
-				fn := funcs[frame.File+frame.Fn]
-				if fn == nil {
-					fn = &profile.Function{
-						ID:         uint64(len(p.Function) + 1),
-						Name:       frame.Fn,
-						SystemName: frame.Fn,
-						Filename:   frame.File,
-					}
-					p.Function = append(p.Function, fn)
-					funcs[frame.File+frame.Fn] = fn
+		for i := 0; i < len(rec.stk); {
+			// The runtime expands inlined calls into several frames
+			// with the same PC, from the innermost to the outermost
+			// call, which make up the lines of a single location.
+			j := inlinedFrames(rec.stk, i)
+			frames := rec.stk[i:j]
+			i = j
+			lk := locKey{pc: frames[0].PC}
+			if prof.opts.mergeByFunc {
+				var lines []string
+				for _, frame := range frames {
+					lines = append(lines, fmt.Sprintf("%s %s:%d", frame.Fn, frame.File, frame.Line))
 				}
+				lk = locKey{lines: strings.Join(lines, "\n")}
+			}
+			loc := locs[lk]
+			if loc == nil {
 				loc = &profile.Location{
 					ID:      uint64(len(p.Location) + 1),
-					Address: frame.PC,
-					Line: []profile.Line{
-						profile.Line{
-							Function: fn,
-							Line:     int64(frame.Line),
-						},
-					},
+					Mapping: mapping,
+					Address: frames[0].PC,
+				}
+				for _, frame := range frames {
+					fn := funcs[frame.File+frame.Fn]
+					if fn == nil {
+						fn = &profile.Function{
+							ID:         uint64(len(p.Function) + 1),
+							Name:       frame.Fn,
+							SystemName: frame.Fn,
+							Filename:   frame.File,
+						}
+						p.Function = append(p.Function, fn)
+						funcs[frame.File+frame.Fn] = fn
+					}
+					loc.Line = append(loc.Line, profile.Line{
+						Function: fn,
+						Line:     int64(frame.Line),
+					})
 				}
 				p.Location = append(p.Location, loc)
-				locs[frame.PC] = loc
+				locs[lk] = loc
 			}
 			sloc = append(sloc, loc)
 		}
-		p.Sample = append(p.Sample, &profile.Sample{
-			Value:    []int64{int64(rec.n), rec.time},
+		s := &profile.Sample{
+			Value:    []int64{int64(rec.n), rec.time / int64(unit.d)},
 			Location: sloc,
-		})
+		}
+		if prof.opts.avg {
+			var avg int64
+			if rec.n > 0 {
+				avg = rec.time / rec.n / int64(unit.d)
+			}
+			s.Value = append(s.Value, avg)
+		}
+		if key.reason != "" {
+			label := prof.reasonLabel
+			if label == "" {
+				label = "reason"
+			}
+			s.Label = map[string][]string{label: {key.reason}}
+		}
+		if key.labels != "" {
+			if s.Label == nil {
+				s.Label = make(map[string][]string)
+			}
+			for _, l := range strings.Split(key.labels, "\n") {
+				kv := strings.SplitN(l, "=", 2)
+				s.Label[kv[0]] = []string{kv[1]}
+			}
+		}
+		if prof.opts.byLabel {
+			s.NumLabel = map[string][]int64{
+				"goroutine": {int64(key.g)},
+				"p":         {int64(key.p)},
+			}
+		}
+		if prof.opts.buckets > 0 {
+			if s.NumLabel == nil {
+				s.NumLabel = make(map[string][]int64)
+			}
+			s.NumLabel["timebucket"] = []int64{int64(key.bucket)}
+		}
+		p.Sample = append(p.Sample, s)
+	}
+	if prof.dropped > 0 {
+		p.Comments = append(p.Comments, droppedSummary(prof))
+	}
+	if prof.skewed > 0 {
+		p.Comments = append(p.Comments, fmt.Sprintf("%s%d events ending before they start", skewedPrefix, prof.skewed))
 	}
 	return p
 }
+
+// inlinedFrames returns the end of the frames of stk starting at i that
+// make up a single location: the frames of the calls inlined at the same
+// PC, which are at different lines. A frame repeating one of them, with
+// the same PC, function and line, is a recursive call, which starts
+// another location.
+func inlinedFrames(stk []*trace.Frame, i int) int {
+	j := i + 1
+	for ; j < len(stk) && stk[j].PC == stk[i].PC; j++ {
+		for _, f := range stk[i:j] {
+			if f.Fn == stk[j].Fn && f.File == stk[j].File && f.Line == stk[j].Line {
+				return j
+			}
+		}
+	}
+	return j
+}
+
+// droppedSummary returns the profile comment reporting the events
+// that were dropped because the trace has no stack for them.
+func droppedSummary(prof *pprofRecords) string {
+	if prof.droppedTime == 0 {
+		return fmt.Sprintf("%s%d events without stack", droppedPrefix, prof.dropped)
+	}
+	total := prof.droppedTime
+	for _, rec := range prof.recs {
+		total += rec.time
+	}
+	return fmt.Sprintf("%s%d events without stack, %v (%.2f%% of the total)", droppedPrefix,
+		prof.dropped, time.Duration(prof.droppedTime), float64(prof.droppedTime)/float64(total)*100)
+}
+
+// droppedPrefix starts the profile comment added by droppedSummary.
+const droppedPrefix = "dropped: "
+
+// skewedPrefix starts the profile comment reporting the skewed events.
+const skewedPrefix = "skewed: "
+
+var buildID struct {
+	once sync.Once
+	id   string
+}
+
+// programBuildID returns the build id of the program binary,
+// or an empty string if it cannot be read.
+func programBuildID() string {
+	buildID.once.Do(func() {
+		buildID.id, _ = buildid.ReadFile(programBinary)
+	})
+	return buildID.id
+}
+
+// collapseRecursion returns stk with the consecutive frames of
+// the same function, as in direct recursion, collapsed into one.
+func collapseRecursion(stk []*trace.Frame) []*trace.Frame {
+	var res []*trace.Frame
+	for _, frame := range stk {
+		if n := len(res); n > 0 && res[n-1].Fn == frame.Fn {
+			continue
+		}
+		res = append(res, frame)
+	}
+	return res
+}
+
+// traceStartTime estimates the wall-clock time of the start of the trace.
+// Traces do not record it, so it is derived from the modification time
+// of the (first) trace file, which is written until tracing stops.
+func traceStartTime() (time.Time, bool) {
+	if traceFile == "" {
+		return time.Time{}, false
+	}
+	fi, err := os.Stat(traceFileNames()[0])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return fi.ModTime().Add(-time.Duration(lastTimestamp() - firstTimestamp())), true
+}
+
+// hideFrames returns the frames of stk whose function
+// names do not match re, collapsing the remaining stack.
+func hideFrames(stk []*trace.Frame, re *regexp.Regexp) []*trace.Frame {
+	var res []*trace.Frame
+	for _, frame := range stk {
+		if !re.MatchString(frame.Fn) {
+			res = append(res, frame)
+		}
+	}
+	return res
+}
+
+// truncatedFrame replaces the outermost frames of the stacks
+// truncated by truncateStack, marking where they were cut.
+var truncatedFrame = &trace.Frame{Fn: "[truncated]"}
+
+// truncateStack returns the n innermost frames of stk, followed by
+// truncatedFrame if frames were removed. The frames of inlined calls,
+// which share their PC, are kept together in a single location, as found
+// by inlinedFrames, so more than n frames are kept when the cut would
+// separate them.
+func truncateStack(stk []*trace.Frame, n int) []*trace.Frame {
+	i := 0
+	for i < n && i < len(stk) {
+		i = inlinedFrames(stk, i)
+	}
+	n = i
+	if n >= len(stk) {
+		return stk
+	}
+	res := make([]*trace.Frame, n, n+1)
+	copy(res, stk)
+	return append(res, truncatedFrame)
+}
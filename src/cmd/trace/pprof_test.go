@@ -0,0 +1,2003 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"internal/trace"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockEvent returns a synchronization blocking event of goroutine g
+// that lasts from begin to end, with a single frame stack named fn.
+func blockEvent(g uint64, begin, end int64, stkID uint64, fn string) *trace.Event {
+	return &trace.Event{
+		Type:  trace.EvGoBlockSync,
+		G:     g,
+		Ts:    begin,
+		StkID: stkID,
+		Stk:   []*trace.Frame{{PC: stkID, Fn: fn}},
+		Link:  &trace.Event{Type: trace.EvGoUnblock, Ts: end},
+	}
+}
+
+// fakeLoaderData replaces the loaded trace, and the goroutines and
+// annotations analyzed from it, with res until restore is called.
+func fakeLoaderData(res trace.ParseResult) (restore func()) {
+	parseTrace()           // fool loader.once.
+	analyzeGoroutines(nil) // fool gsInit once.
+	analyzeAnnotations()   // fool annotations once.
+	oldRes, oldErr, oldTraces, oldNames := loader.res, loader.err, loader.traces, loader.names
+	oldGs, oldAnnotations, oldAnnotationsErr := gs, annotations.res, annotations.err
+	swapLoaderData(res, nil)
+	return func() {
+		loader.res, loader.err, loader.traces, loader.names = oldRes, oldErr, oldTraces, oldNames
+		gs, annotations.res, annotations.err = oldGs, oldAnnotations, oldAnnotationsErr
+	}
+}
+
+func TestMergeIntervals(t *testing.T) {
+	cases := []struct {
+		in, want []interval
+	}{
+		{nil, nil},
+		{[]interval{{1, 10}}, []interval{{1, 10}}},
+		{[]interval{{1, 10}, {20, 30}}, []interval{{1, 10}, {20, 30}}},
+		{[]interval{{20, 30}, {1, 10}}, []interval{{1, 10}, {20, 30}}},
+		{[]interval{{1, 20}, {10, 40}}, []interval{{1, 40}}},
+		{[]interval{{1, 40}, {10, 20}}, []interval{{1, 40}}},
+		{[]interval{{10, 20}, {1, 10}, {30, 40}, {35, 50}}, []interval{{1, 20}, {30, 50}}},
+	}
+	for _, tc := range cases {
+		if got := mergeIntervals(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("mergeIntervals(%v) = %v; want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestIntersectIntervals(t *testing.T) {
+	cases := []struct {
+		a, b, want []interval
+	}{
+		{nil, []interval{{1, 10}}, nil},
+		{[]interval{{1, 10}}, nil, nil},
+		{[]interval{{1, 10}}, []interval{{5, 20}}, []interval{{5, 10}}},
+		{[]interval{{1, 10}, {20, 30}}, []interval{{5, 25}}, []interval{{5, 10}, {20, 25}}},
+		{[]interval{{1, 10}}, []interval{{10, 20}}, nil},
+	}
+	for _, tc := range cases {
+		if got := intersectIntervals(tc.a, tc.b); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("intersectIntervals(%v, %v) = %v; want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestClosestGoroutineTypes(t *testing.T) {
+	gs := map[uint64]*trace.GDesc{
+		1: {ID: 1, PC: 100, Name: "main.a"},
+		2: {ID: 2, PC: 100, Name: "main.a"},
+		3: {ID: 3, PC: 130, Name: "main.b"},
+		4: {ID: 4, PC: 90, Name: "main.c"},
+		5: {ID: 5, PC: 500, Name: "main.d"},
+		6: {ID: 6}, // a goroutine that existed before the trace started.
+	}
+	want := []string{"100 (main.a)", "90 (main.c)", "130 (main.b)"}
+	if got := closestGoroutineTypes(gs, 101, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("closestGoroutineTypes = %q; want %q", got, want)
+	}
+	if got := closestGoroutineTypes(nil, 101, 3); len(got) != 0 {
+		t.Errorf("closestGoroutineTypes(nil) = %q; want none", got)
+	}
+}
+
+// TestOverlappingIntervals tests an event is never counted more
+// than its own duration when the filter intervals overlap.
+func TestOverlappingIntervals(t *testing.T) {
+	events := []*trace.Event{blockEvent(1, 10, 50, 1, "main.f")}
+	gToIntervals := map[uint64][]interval{
+		1: {{begin: 0, end: 30}, {begin: 20, end: 60}},
+	}
+	p, err := computeProfile(profileBlock, events, gToIntervals, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 {
+		t.Fatalf("got %d samples; want 1", len(p.Sample))
+	}
+	if got, want := p.Sample[0].Value[1], int64(40); got != want {
+		t.Errorf("delay = %d; want %d", got, want)
+	}
+}
+
+func TestWriteTextProfile(t *testing.T) {
+	f := &trace.Frame{PC: 1, Fn: "main.f"}
+	g := &trace.Frame{PC: 2, Fn: "main.g"}
+	mainFn := &trace.Frame{PC: 3, Fn: "main.main"}
+	prof := newPprofRecords(nil)
+	prof.add(&trace.Event{}, 1, []*trace.Frame{f, mainFn}, 30)
+	prof.add(&trace.Event{}, 2, []*trace.Frame{g, f, mainFn}, 10)
+
+	var buf bytes.Buffer
+	if err := writeTextProfile(&buf, buildProfile(prof)); err != nil {
+		t.Fatalf("writeTextProfile failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []struct {
+		fn        string
+		flat, cum string
+	}{
+		{"main.f", "30ns", "40ns"},
+		{"main.g", "10ns", "10ns"},
+		{"main.main", "0s", "40ns"},
+	}
+	if len(lines) != len(want)+2 {
+		t.Fatalf("got %d lines; want %d:\n%s", len(lines), len(want)+2, buf.String())
+	}
+	for i, w := range want {
+		fields := strings.Fields(lines[i+2])
+		if got := fields[len(fields)-1]; got != w.fn {
+			t.Errorf("line %d: function = %q; want %q", i, got, w.fn)
+		}
+		if fields[0] != w.flat || fields[3] != w.cum {
+			t.Errorf("line %d: flat, cum = %s, %s; want %s, %s", i, fields[0], fields[3], w.flat, w.cum)
+		}
+	}
+}
+
+func TestSubtractRecords(t *testing.T) {
+	// The same stack has different ids in the two traces,
+	// and the same id is used for different stacks.
+	base := newPprofRecords(nil)
+	pprofBlockRecords(base, nil, []*trace.Event{
+		blockEvent(1, 0, 30, 1, "main.f"),
+		blockEvent(1, 40, 50, 7, "main.g"),
+	})
+	prof := newPprofRecords(nil)
+	pprofBlockRecords(prof, nil, []*trace.Event{
+		blockEvent(1, 0, 50, 7, "main.f"),
+		blockEvent(1, 60, 80, 8, "main.h"),
+	})
+	prof.subtract(base)
+
+	got := make(map[string]int64)
+	for _, rec := range prof.recs {
+		got[rec.stk[0].Fn] = rec.time
+	}
+	want := map[string]int64{"main.f": 20, "main.g": -10, "main.h": 20}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	// Records of the same stack with different labels are told apart.
+	stk := []*trace.Frame{{PC: 1, Fn: "main.f"}}
+	base = newPprofRecords(nil)
+	base.addLabels(&trace.Event{}, 1, stk, 10, "unblock", "idlep=yes")
+	base.addLabels(&trace.Event{}, 1, stk, 30, "unblock", "idlep=no")
+	prof = newPprofRecords(nil)
+	prof.addLabels(&trace.Event{}, 2, stk, 50, "unblock", "idlep=yes")
+	prof.subtract(base)
+	got = make(map[string]int64)
+	for key, rec := range prof.recs {
+		got[key.labels] = rec.time
+	}
+	want = map[string]int64{"idlep=yes": 40, "idlep=no": -30}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("with labels: got %v; want %v", got, want)
+	}
+}
+
+// TestMinDuration tests the minimum duration applies to the
+// duration within the filter intervals, not the event duration.
+func TestMinDuration(t *testing.T) {
+	events := []*trace.Event{
+		blockEvent(1, 0, 100, 1, "main.f"),
+		blockEvent(1, 100, 105, 2, "main.g"),
+		blockEvent(1, 200, 300, 3, "main.h"),
+	}
+	gToIntervals := map[uint64][]interval{
+		1: {{begin: 0, end: 150}, {begin: 290, end: 300}},
+	}
+	prof := newPprofRecords(&pprofOptions{minDuration: 20})
+	pprofBlockRecords(prof, gToIntervals, events)
+
+	var got []string
+	for _, rec := range prof.recs {
+		got = append(got, rec.stk[0].Fn)
+	}
+	if want := []string{"main.f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got records of %v; want %v", got, want)
+	}
+}
+
+func TestBuildProfileInlined(t *testing.T) {
+	// main.g is inlined into main.f, so both frames have the same PC.
+	stk := []*trace.Frame{
+		{PC: 1, Fn: "main.g", Line: 10},
+		{PC: 1, Fn: "main.f", Line: 20},
+		{PC: 2, Fn: "main.main", Line: 30},
+	}
+	prof := newPprofRecords(nil)
+	prof.add(&trace.Event{}, 1, stk, 10)
+	p := buildProfile(prof)
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+	if len(p.Sample) != 1 || len(p.Sample[0].Location) != 2 {
+		t.Fatalf("got %d samples; want 1 sample with 2 locations:\n%v", len(p.Sample), p)
+	}
+	var got []string
+	for _, l := range p.Sample[0].Location[0].Line {
+		got = append(got, l.Function.Name)
+	}
+	if want := []string{"main.g", "main.f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lines of the innermost location = %v; want %v", got, want)
+	}
+
+	// main.r calls itself directly, from the same call site, so its
+	// frames have the same PC but each is a location of its own.
+	stk = []*trace.Frame{
+		{PC: 1, Fn: "main.r", Line: 20},
+		{PC: 1, Fn: "main.r", Line: 20},
+		{PC: 1, Fn: "main.r", Line: 20},
+		{PC: 2, Fn: "main.main", Line: 30},
+	}
+	prof = newPprofRecords(nil)
+	prof.add(&trace.Event{}, 1, stk, 10)
+	p = buildProfile(prof)
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+	var lines []int
+	for _, loc := range p.Sample[0].Location {
+		lines = append(lines, len(loc.Line))
+	}
+	if want := []int{1, 1, 1, 1}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("recursive stack: got locations with %v lines; want %v", lines, want)
+	}
+}
+
+func TestBuildProfileMergeByFunc(t *testing.T) {
+	// main.f is called from the same line at two different PCs.
+	stk1 := []*trace.Frame{{PC: 1, Fn: "main.f", File: "f.go", Line: 10}, {PC: 3, Fn: "main.main", File: "f.go", Line: 30}}
+	stk2 := []*trace.Frame{{PC: 2, Fn: "main.f", File: "f.go", Line: 10}, {PC: 3, Fn: "main.main", File: "f.go", Line: 30}}
+	for _, tc := range []struct {
+		mergeByFunc bool
+		want        int
+	}{
+		{false, 3},
+		{true, 2},
+	} {
+		prof := newPprofRecords(&pprofOptions{mergeByFunc: tc.mergeByFunc})
+		prof.add(&trace.Event{}, 1, stk1, 10)
+		prof.add(&trace.Event{}, 2, stk2, 10)
+		p := buildProfile(prof)
+		if err := p.CheckValid(); err != nil {
+			t.Fatalf("invalid profile: %v", err)
+		}
+		if len(p.Location) != tc.want {
+			t.Errorf("mergeByFunc=%v: got %d locations; want %d", tc.mergeByFunc, len(p.Location), tc.want)
+		}
+	}
+}
+
+func TestGCPauseRecords(t *testing.T) {
+	stw := func(begin, end int64) *trace.Event {
+		return &trace.Event{
+			Type: trace.EvGCSTWStart,
+			Ts:   begin,
+			Link: &trace.Event{Type: trace.EvGCSTWDone, Ts: end},
+		}
+	}
+	events := []*trace.Event{
+		{Type: trace.EvGCStart, Ts: 0, StkID: 1, Stk: []*trace.Frame{{PC: 1, Fn: "main.f"}}},
+		stw(0, 10),
+		stw(50, 70),
+	}
+	// The intervals of the goroutines overlap, but the
+	// pause time must be accounted for only once.
+	gToIntervals := map[uint64][]interval{
+		1: {{begin: 5, end: 60}},
+		2: {{begin: 0, end: 55}},
+	}
+	p, err := computeProfile(profileGCPause, events, gToIntervals, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 {
+		t.Fatalf("got %d samples; want 1", len(p.Sample))
+	}
+	if got, want := p.Sample[0].Value[1], int64(20); got != want {
+		t.Errorf("delay = %d; want %d", got, want)
+	}
+}
+
+func TestGCAssistPhases(t *testing.T) {
+	events := []*trace.Event{
+		{Type: trace.EvGCMarkAssistStart, G: 1, Ts: 0, StkID: 1, Stk: []*trace.Frame{{PC: 1, Fn: "main.f"}},
+			Link: &trace.Event{Type: trace.EvGCMarkAssistDone, Ts: 10}},
+		{Type: trace.EvGCSweepStart, G: 2, Ts: 0, StkID: 2, Stk: []*trace.Frame{{PC: 2, Fn: "main.g"}},
+			Link: &trace.Event{Type: trace.EvGCSweepDone, Ts: 30}},
+	}
+	p, err := computeProfile(profileGCAssist, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, s := range p.Sample {
+		got[s.Label["phase"][0]] += s.Value[1]
+	}
+	if want := map[string]int64{"mark": 10, "sweep": 30}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got delay by phase %v; want %v", got, want)
+	}
+}
+
+func TestHideFrames(t *testing.T) {
+	stk := []*trace.Frame{
+		{PC: 1, Fn: "runtime.chansend"},
+		{PC: 2, Fn: "main.g"},
+		{PC: 3, Fn: "main.f"},
+		{PC: 4, Fn: "runtime.main"},
+	}
+	r := httptest.NewRequest("GET", "/block?hideruntime=1&hide=^main%5C.g$", nil)
+	opts, err := newPprofOptions(r)
+	if err != nil {
+		t.Fatalf("newPprofOptions failed: %v", err)
+	}
+	prof := newPprofRecords(opts)
+	prof.add(&trace.Event{}, 1, stk, 10)
+	p := buildProfile(prof)
+	var got []string
+	for _, loc := range p.Sample[0].Location {
+		got = append(got, loc.Line[0].Function.Name)
+	}
+	if want := []string{"main.f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got stack %v; want %v", got, want)
+	}
+
+	r = httptest.NewRequest("GET", "/block?hide=(", nil)
+	if _, err := newPprofOptions(r); err == nil {
+		t.Errorf("newPprofOptions succeeded with an invalid hide parameter")
+	}
+}
+
+func TestWeightParameter(t *testing.T) {
+	for _, tc := range []struct {
+		url, err string
+	}{
+		{"/io", ""},
+		{"/io?weight=time", ""},
+		{"/io?weight=bytes", ""},
+		{"/io?weight=calls", "invalid weight parameter"},
+	} {
+		_, err := newPprofOptions(httptest.NewRequest("GET", tc.url, nil))
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: newPprofOptions failed: %v", tc.url, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: got error %v; want %q", tc.url, err, tc.err)
+		}
+	}
+
+	events := []*trace.Event{blockEvent(1, 0, 10, 1, "main.f")}
+	for _, tc := range []struct {
+		kind profileKind
+		err  string
+	}{
+		{profileIO, "not supported by this trace: network blocking events do not record byte counts"},
+		{profileIORead, "not supported by this trace"},
+		{profileBlock, "not supported by the block profile: only network blocking profiles"},
+		{profileSched, "not supported by the sched profile"},
+	} {
+		_, err := computeProfile(tc.kind, events, nil, &pprofOptions{weightBytes: true})
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: got error %v; want %q", tc.kind, err, tc.err)
+		}
+	}
+}
+
+func TestCanceledProfile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	prof := newPprofRecords(&pprofOptions{ctx: ctx})
+	events := []*trace.Event{blockEvent(1, 0, 10, 1, "main.f")}
+	if err := pprofKindRecords(prof, profileBlock, nil, events); err != context.Canceled {
+		t.Errorf("pprofKindRecords returned %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestGoroutineCountRecords(t *testing.T) {
+	stk := []*trace.Frame{{PC: 1, Fn: "main.f"}}
+	create := func(g uint64) *trace.Event {
+		return &trace.Event{Type: trace.EvGoCreate, G: 1, StkID: 1, Stk: stk, Args: [3]uint64{g}}
+	}
+	end := func(g uint64) *trace.Event {
+		return &trace.Event{Type: trace.EvGoEnd, G: g}
+	}
+	events := []*trace.Event{
+		create(2), create(3), end(2), create(4), create(5), end(3), end(4), end(5), create(6),
+	}
+	prof := newPprofRecords(nil)
+	if err := pprofGoroutineCountRecords(prof, nil, events); err != nil {
+		t.Fatalf("pprofGoroutineCountRecords failed: %v", err)
+	}
+	rec := prof.recs[recordKey{stkID: 1}]
+	if rec.n != 5 || rec.time != 3 {
+		t.Errorf("got %d goroutines, peak %d; want 5, peak 3", rec.n, rec.time)
+	}
+}
+
+func TestRunningRecords(t *testing.T) {
+	frame := func(fn string) []*trace.Frame { return []*trace.Frame{{PC: uint64(len(fn)), Fn: fn}} }
+	events := []*trace.Event{
+		{Type: trace.EvGoStart, G: 1, Ts: 0, Link: &trace.Event{Type: trace.EvGoBlock, G: 1, Ts: 100, StkID: 1, Stk: frame("main.block")}},
+		{Type: trace.EvGoStart, G: 2, Ts: 0, Link: &trace.Event{Type: trace.EvGoBlock, G: 2, Ts: 30, StkID: 2, Stk: frame("main.stop")}},
+		{Type: trace.EvGoCreate, G: 1, Ts: 20, StkID: 3, Stk: frame("main.spawn")},
+		{Type: trace.EvGoStart, G: 3, Ts: 40, Link: &trace.Event{Type: trace.EvGoBlock, G: 3, Ts: 90, StkID: 4, Stk: frame("main.wait")}},
+	}
+	prof := newPprofRecords(&pprofOptions{byLabel: true})
+	if err := pprofRunningRecords(prof, events, 50); err != nil {
+		t.Fatalf("pprofRunningRecords failed: %v", err)
+	}
+	got := make(map[uint64]string)
+	for key, rec := range prof.recs {
+		got[key.g] = fmt.Sprintf("%s %d", rec.stk[0].Fn, rec.time)
+	}
+	// Goroutine 2 stopped running before the instant.
+	want := map[uint64]string{1: "main.spawn 50", 3: "main.wait 10"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %v; want %v", got, want)
+	}
+
+	defer fakeLoaderData(trace.ParseResult{Events: []*trace.Event{
+		{Type: trace.EvGoCreate, Ts: 0, Args: [3]uint64{1}},
+		{Type: trace.EvGoStart, G: 1, Ts: 0, StkID: 1, Stk: frame("main.f")},
+		{Type: trace.EvGoSched, G: 1, Ts: 100},
+	}})()
+	for _, url := range []string{"/running", "/running?at=x", "/running?at=-1", "/running?at=1000"} {
+		err := pprofRunning(ioutil.Discard, httptest.NewRequest("GET", url, nil))
+		if _, ok := err.(*paramError); !ok {
+			t.Errorf("%s: got error %#v; want a parameter error", url, err)
+		}
+	}
+}
+
+func TestProfileComments(t *testing.T) {
+	p, err := computeProfile(profileSyscall, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	found := false
+	for _, c := range p.Comments {
+		if c == "kind: syscall" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("profile comments %q do not include the profile kind", p.Comments)
+	}
+	if p.DefaultSampleType != "delay" {
+		t.Errorf("got default sample type %q; want delay", p.DefaultSampleType)
+	}
+}
+
+func TestNestedIntervals(t *testing.T) {
+	events := []*trace.Event{blockEvent(1, 0, 50, 1, "main.f")}
+	gToIntervals := map[uint64][]interval{
+		1: {{begin: 0, end: 30}, {begin: 10, end: 20}},
+	}
+	for _, tc := range []struct {
+		nested bool
+		want   int64
+	}{
+		{false, 30},
+		{true, 40},
+	} {
+		p, err := computeProfile(profileBlock, events, gToIntervals, &pprofOptions{nested: tc.nested})
+		if err != nil {
+			t.Fatalf("computeProfile failed: %v", err)
+		}
+		if got := p.Sample[0].Value[1]; got != tc.want {
+			t.Errorf("nested=%v: delay = %d; want %d", tc.nested, got, tc.want)
+		}
+	}
+}
+
+func TestSyscallBlockedOnly(t *testing.T) {
+	stk := []*trace.Frame{{PC: 1, Fn: "syscall.Read"}}
+	exit := &trace.Event{Type: trace.EvGoSysExit, G: 1, Ts: 100}
+	events := []*trace.Event{
+		{Type: trace.EvGoSysCall, G: 1, Ts: 0, StkID: 1, Stk: stk}, // quick syscall, no exit
+		{Type: trace.EvGoSysCall, G: 1, Ts: 10, StkID: 1, Stk: stk, Link: exit},
+		{Type: trace.EvGoSysBlock, G: 1, Ts: 30},
+		exit,
+	}
+	for _, tc := range []struct {
+		blockedOnly bool
+		want        int64
+	}{
+		{false, 90},
+		{true, 70},
+	} {
+		p, err := computeProfile(profileSyscall, events, nil, &pprofOptions{blockedOnly: tc.blockedOnly})
+		if err != nil {
+			t.Fatalf("computeProfile failed: %v", err)
+		}
+		if len(p.Sample) != 1 {
+			t.Fatalf("blockedonly=%v: got %d samples; want 1", tc.blockedOnly, len(p.Sample))
+		}
+		if got := p.Sample[0].Value[1]; got != tc.want {
+			t.Errorf("blockedonly=%v: delay = %d; want %d", tc.blockedOnly, got, tc.want)
+		}
+	}
+}
+
+func TestSyscallName(t *testing.T) {
+	for _, tc := range []struct {
+		stk  []string
+		want string
+	}{
+		{[]string{"syscall.Syscall", "syscall.read", "syscall.Read", "os.(*File).Read"}, "read"},
+		{[]string{"syscall.Syscall6", "golang.org/x/sys/unix.EpollWait", "main.loop"}, "epollwait"},
+		{[]string{"runtime.cgocall", "syscall.(*Proc).Call", "main.call"}, "main.call"},
+		{[]string{"runtime.notetsleepg", "os/signal.signal_recv"}, "os/signal.signal_recv"},
+		{[]string{"runtime.entersyscall"}, ""},
+	} {
+		var stk []*trace.Frame
+		for _, fn := range tc.stk {
+			stk = append(stk, &trace.Frame{Fn: fn})
+		}
+		if got := syscallName(stk); got != tc.want {
+			t.Errorf("syscallName(%v) = %q; want %q", tc.stk, got, tc.want)
+		}
+	}
+
+	stk := []*trace.Frame{{PC: 1, Fn: "syscall.Syscall"}, {PC: 2, Fn: "syscall.write"}}
+	exit := &trace.Event{Type: trace.EvGoSysExit, G: 1, Ts: 100}
+	events := []*trace.Event{
+		{Type: trace.EvGoSysCall, G: 1, Ts: 10, StkID: 1, Stk: stk, Link: exit},
+		exit,
+	}
+	p, err := computeProfile(profileSyscall, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 {
+		t.Fatalf("got %d samples; want 1", len(p.Sample))
+	}
+	if got := p.Sample[0].Label["syscall"]; !reflect.DeepEqual(got, []string{"write"}) {
+		t.Errorf("got syscall label %q; want [write]", got)
+	}
+}
+
+func TestEmptyProfile(t *testing.T) {
+	handler := serveSVGProfile(func(w io.Writer, r *http.Request) error {
+		return computePprof(w, profileBlock, nil, nil, nil)
+	})
+	for _, tc := range []struct {
+		url  string
+		code int
+	}{
+		{"/block?raw=1", http.StatusNoContent},
+		{"/block", http.StatusNotFound},
+		{"/block?format=text", http.StatusNotFound},
+		{"/block?format=raw-text", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", tc.url, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s: got status %d; want %d", tc.url, rec.Code, tc.code)
+		}
+	}
+}
+
+func TestRawTextProfile(t *testing.T) {
+	events := []*trace.Event{blockEvent(1, 0, 100, 1, "main.f")}
+	handler := serveSVGProfile(func(w io.Writer, r *http.Request) error {
+		return computePprof(w, profileBlock, nil, events, nil)
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/block?format=raw-text", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", rec.Code, http.StatusOK)
+	}
+	for _, want := range []string{"Samples:", "contentions/count delay/nanoseconds", "main.f"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("raw text profile does not contain %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
+
+func TestSVGProfileTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace-pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", dir)
+	defer func(old func() string) { goCmd = old }(goCmd)
+
+	events := []*trace.Event{blockEvent(1, 0, 100, 1, "main.f")}
+	handler := serveSVGProfile(func(w io.Writer, r *http.Request) error {
+		return computePprof(w, profileBlock, nil, events, nil)
+	})
+	failing := []string{filepath.Join(dir, "nonexistent")} // served by the text fallback.
+	if path, err := exec.LookPath("false"); err == nil {
+		failing = append(failing, path)
+	}
+	for _, cmd := range failing {
+		goCmd = func() string { return cmd }
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/block", nil))
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			t.Errorf("%s: temp file %s was not removed", cmd, f.Name())
+		}
+	}
+}
+
+func TestSVGProfileTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script")
+	}
+	dir, err := ioutil.TempDir("", "trace-pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hanging := filepath.Join(dir, "go")
+	if err := ioutil.WriteFile(hanging, []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old func() string) { goCmd = old }(goCmd)
+	goCmd = func() string { return hanging }
+	defer func(d time.Duration) { *pprofTimeoutFlag = d }(*pprofTimeoutFlag)
+	*pprofTimeoutFlag = 10 * time.Millisecond
+
+	events := []*trace.Event{blockEvent(1, 0, 100, 1, "main.f")}
+	handler := serveSVGProfile(func(w io.Writer, r *http.Request) error {
+		return computePprof(w, profileBlock, nil, events, nil)
+	})
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	handler(rec, httptest.NewRequest("GET", "/block", nil))
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("handler returned after %v; want it killed after the timeout", d)
+	}
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("got status %d; want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+}
+
+func TestPprofUnavailable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script")
+	}
+	dir, err := ioutil.TempDir("", "trace-pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	noTool := filepath.Join(dir, "go")
+	if err := ioutil.WriteFile(noTool, []byte("#!/bin/sh\necho 'go tool: no such tool \"pprof\"' >&2\nexit 2\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old func() string) { goCmd = old }(goCmd)
+	defer func(old string) { *pprofBinFlag = old }(*pprofBinFlag)
+
+	events := []*trace.Event{blockEvent(1, 0, 100, 1, "main.f")}
+	for _, tc := range []struct {
+		name       string
+		goCmd, bin string
+	}{
+		{"no pprof tool", noTool, ""},
+		{"no go command", filepath.Join(dir, "missing", "go"), ""},
+		{"no pprof binary", noTool, filepath.Join(dir, "missing", "pprof")},
+	} {
+		goCmd = func() string { return tc.goCmd }
+		*pprofBinFlag = tc.bin
+		handler := serveSVGProfile(func(w io.Writer, r *http.Request) error {
+			return computePprof(w, profileBlock, nil, events, nil)
+		})
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/block", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: got status %d; want the text report", tc.name, rec.Code)
+		}
+		body := rec.Body.String()
+		for _, want := range []string{"go tool pprof is not available", "/block?raw=1", "go tool pprof -http=:0 block.pb.gz", "main.f"} {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: report does not contain %q:\n%s", tc.name, want, body)
+			}
+		}
+	}
+}
+
+func TestRenderSVG(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script")
+	}
+	dir, err := ioutil.TempDir("", "trace-pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The fake pprof prints its arguments, but the file, and the profile.
+	pprof := filepath.Join(dir, "pprof")
+	script := "#!/bin/sh\nfor f; do :; done\necho \"<svg>$1 $2\"\ncat \"$f\"\necho '</svg>'\n"
+	if err := ioutil.WriteFile(pprof, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(bin string) { *pprofBinFlag = bin }(*pprofBinFlag)
+	*pprofBinFlag = pprof
+
+	svg, err := renderSVG(context.Background(), []byte("profile"), []string{"-nodecount=10"})
+	if err != nil {
+		t.Fatalf("renderSVG failed: %v", err)
+	}
+	if want := "<svg>-svg -nodecount=10\nprofile</svg>\n"; string(svg) != want {
+		t.Errorf("got svg %q; want %q", svg, want)
+	}
+
+	*pprofBinFlag = filepath.Join(dir, "missing")
+	if _, err := renderSVG(context.Background(), []byte("profile"), nil); err == nil {
+		t.Errorf("renderSVG with a missing pprof succeeded")
+	} else if _, ok := err.(*pprofExecError); !ok {
+		t.Errorf("renderSVG with a missing pprof: got error %v; want a pprofExecError", err)
+	}
+}
+
+func TestSVGProfileGzip(t *testing.T) {
+	const svg = "<svg>cached</svg>"
+	svgCache.add("/block?gzip=test", []byte(svg))
+	handler := serveSVGProfile(func(w io.Writer, r *http.Request) error {
+		return fmt.Errorf("the cached svg was not served")
+	})
+	for _, tc := range []struct {
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=1.0, *;q=0.5", true},
+		{"br", false},
+		{"gzip;q=0", false},
+	} {
+		req := httptest.NewRequest("GET", "/block?gzip=test", nil)
+		if tc.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		body := rec.Body.String()
+		if gzipped := rec.Header().Get("Content-Encoding") == "gzip"; gzipped != tc.gzipped {
+			t.Errorf("Accept-Encoding %q: gzipped = %v; want %v", tc.acceptEncoding, gzipped, tc.gzipped)
+			continue
+		}
+		if tc.gzipped {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("Accept-Encoding %q: %v", tc.acceptEncoding, err)
+			}
+			b, err := ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("Accept-Encoding %q: %v", tc.acceptEncoding, err)
+			}
+			body = string(b)
+		}
+		if body != svg {
+			t.Errorf("Accept-Encoding %q: got body %q; want %q", tc.acceptEncoding, body, svg)
+		}
+	}
+}
+
+func TestPprofCommand(t *testing.T) {
+	defer func(old func() string) { goCmd = old }(goCmd)
+	goCmd = func() string { return "/goroot/bin/go" }
+	defer func(bin string) { *pprofBinFlag = bin }(*pprofBinFlag)
+	for _, tc := range []struct {
+		bin  string
+		want []string
+	}{
+		{"", []string{"/goroot/bin/go", "tool", "pprof", "-svg", "block.pprof"}},
+		{"/usr/local/bin/pprof", []string{"/usr/local/bin/pprof", "-svg", "block.pprof"}},
+	} {
+		*pprofBinFlag = tc.bin
+		cmd := pprofCommand(context.Background(), "-svg", "block.pprof")
+		if cmd.Path != tc.want[0] || !reflect.DeepEqual(cmd.Args, tc.want) {
+			t.Errorf("-pprof-bin=%q: got command %s %q; want %q", tc.bin, cmd.Path, cmd.Args, tc.want)
+		}
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.add("a", []byte("1"))
+	c.add("b", []byte("2"))
+	if _, ok := c.get("a"); !ok { // a is now more recently used than b.
+		t.Errorf("a is not cached")
+	}
+	c.add("c", []byte("3"))
+	if _, ok := c.get("b"); ok {
+		t.Errorf("b is still cached; want it evicted")
+	}
+	for key, want := range map[string]string{"a": "1", "c": "3"} {
+		if got, ok := c.get(key); !ok || string(got) != want {
+			t.Errorf("get(%q) = %q, %v; want %q", key, got, ok, want)
+		}
+	}
+}
+
+func TestRawProfileErrors(t *testing.T) {
+	block := serveSVGProfile(pprofByGoroutine(computePprofKind(profileBlock)))
+	empty := serveSVGProfile(func(w io.Writer, r *http.Request) error {
+		return computePprof(w, profileBlock, nil, nil, nil)
+	})
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		url     string
+		status  int
+	}{
+		{block, "/block?raw=1&bylabel=x", http.StatusBadRequest},
+		{block, "/block?bylabel=x", http.StatusBadRequest},
+		{serveSVGProfile(pprofBySpan(computePprofKind(profileBlock))), "/spanblock?raw=1&latmin=x", http.StatusBadRequest},
+		{empty, "/block?raw=1", http.StatusNoContent},
+		{empty, "/block", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest("GET", tc.url, nil))
+		if rec.Code != tc.status {
+			t.Errorf("%s: got status %d; want %d (%s)", tc.url, rec.Code, tc.status, strings.TrimSpace(rec.Body.String()))
+		}
+	}
+}
+
+func TestRawProfileValidators(t *testing.T) {
+	f, err := ioutil.TempFile("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	defer func(old string) { traceFile = old }(traceFile)
+	traceFile = f.Name()
+
+	calls := 0
+	handler := serveSVGProfile(func(w io.Writer, r *http.Request) error {
+		calls++
+		_, err := io.WriteString(w, "profile")
+		return err
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/block?raw=1", nil))
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || rec.Body.String() != "profile" || etag == "" {
+		t.Fatalf("got status %d, body %q, ETag %q; want the profile with an ETag", rec.Code, rec.Body, etag)
+	}
+	if got := rec.Header().Get("Content-Length"); got != "7" {
+		t.Errorf("got Content-Length %q; want 7", got)
+	}
+
+	req := httptest.NewRequest("GET", "/block?raw=1", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusNotModified || calls != 1 {
+		t.Errorf("got status %d after %d calls; want %d after 1 call", rec.Code, calls, http.StatusNotModified)
+	}
+
+	req = httptest.NewRequest("GET", "/block?raw=1&min=1ms", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d for other parameters; want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestPprofGraphFlags(t *testing.T) {
+	r := httptest.NewRequest("GET", "/block?focus=main%5C.f&ignore=runtime", nil)
+	flags, err := pprofGraphFlags(r)
+	if err != nil {
+		t.Fatalf("pprofGraphFlags failed: %v", err)
+	}
+	if want := []string{`-focus=main\.f`, "-ignore=runtime"}; !reflect.DeepEqual(flags, want) {
+		t.Errorf("got flags %q; want %q", flags, want)
+	}
+	r = httptest.NewRequest("GET", "/block?ignore=(", nil)
+	if _, err := pprofGraphFlags(r); err == nil {
+		t.Errorf("pprofGraphFlags succeeded with an invalid ignore parameter")
+	}
+	r = httptest.NewRequest("GET", "/block?value=count", nil)
+	if flags, err := pprofGraphFlags(r); err != nil || !reflect.DeepEqual(flags, []string{"-sample_index=0"}) {
+		t.Errorf("got flags %q, %v; want -sample_index=0", flags, err)
+	}
+	r = httptest.NewRequest("GET", "/block?value=avgdelay&avg=1", nil)
+	if flags, err := pprofGraphFlags(r); err != nil || !reflect.DeepEqual(flags, []string{"-sample_index=avgdelay"}) {
+		t.Errorf("got flags %q, %v; want -sample_index=avgdelay", flags, err)
+	}
+	r = httptest.NewRequest("GET", "/block?value=avgdelay", nil)
+	if _, err := pprofGraphFlags(r); err == nil {
+		t.Errorf("pprofGraphFlags succeeded with value=avgdelay without avg=1")
+	}
+	r = httptest.NewRequest("GET", "/block?value=bytes", nil)
+	if _, err := pprofGraphFlags(r); err == nil {
+		t.Errorf("pprofGraphFlags succeeded with an invalid value parameter")
+	}
+	r = httptest.NewRequest("GET", "/block?nodecount=20&nodefraction=0.05", nil)
+	if flags, err := pprofGraphFlags(r); err != nil || !reflect.DeepEqual(flags, []string{"-nodecount=20", "-nodefraction=0.05"}) {
+		t.Errorf("got flags %q, %v; want -nodecount=20 -nodefraction=0.05", flags, err)
+	}
+	for _, url := range []string{"/block?nodecount=x", "/block?nodecount=-1", "/block?nodefraction=2"} {
+		if _, err := pprofGraphFlags(httptest.NewRequest("GET", url, nil)); err == nil {
+			t.Errorf("%s: pprofGraphFlags succeeded with an invalid parameter", url)
+		}
+	}
+}
+
+func TestDelayUnit(t *testing.T) {
+	events := []*trace.Event{blockEvent(1, 0, int64(3*time.Millisecond), 1, "main.f")}
+	p, err := computeProfile(profileBlock, events, nil, &pprofOptions{unit: delayUnits["ms"]})
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if got, want := p.SampleType[1].Unit, "milliseconds"; got != want {
+		t.Errorf("delay unit = %q; want %q", got, want)
+	}
+	if got, want := p.Sample[0].Value[1], int64(3); got != want {
+		t.Errorf("delay = %d; want %d", got, want)
+	}
+	var buf bytes.Buffer
+	if err := writeTextProfile(&buf, p); err != nil {
+		t.Fatalf("writeTextProfile failed: %v", err)
+	}
+	if !strings.Contains(buf.String(), "total delay 3ms") {
+		t.Errorf("text profile does not report the delay in milliseconds:\n%s", buf.String())
+	}
+}
+
+func TestParallelRecords(t *testing.T) {
+	var events []*trace.Event
+	for i := 0; i < 1000; i++ {
+		stkID := uint64(i%7 + 1)
+		events = append(events, blockEvent(uint64(i%3), int64(i*10), int64(i*10+i%13), stkID, fmt.Sprintf("main.f%d", stkID)))
+	}
+	seq := newPprofRecords(nil)
+	if err := pprofKindRecords(seq, profileBlock, nil, events); err != nil {
+		t.Fatalf("pprofKindRecords failed: %v", err)
+	}
+
+	defer func(n int) { minShardEvents = n }(minShardEvents)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	minShardEvents = 10
+	par := newPprofRecords(nil)
+	if err := pprofKindRecords(par, profileBlock, nil, events); err != nil {
+		t.Fatalf("pprofKindRecords failed: %v", err)
+	}
+	if !reflect.DeepEqual(seq.recs, par.recs) {
+		t.Errorf("parallel scan records differ from sequential scan:\n%v\n%v", par.recs, seq.recs)
+	}
+}
+
+func TestSelectEvents(t *testing.T) {
+	if err := traceProgram(t, prog0, "TestSelectEvents"); err != nil {
+		t.Fatalf("failed to trace the program: %v", err)
+	}
+	events, err := parseEvents()
+	if err != nil {
+		t.Fatalf("failed to parse events: %v", err)
+	}
+	types := []byte{trace.EvGoCreate, trace.EvGoUnblock, trace.EvGoStart}
+	var want []*trace.Event
+	for _, ev := range events {
+		if ev.Type == trace.EvGoCreate || ev.Type == trace.EvGoUnblock || ev.Type == trace.EvGoStart {
+			want = append(want, ev)
+		}
+	}
+	// The loaded events are looked up in the index,
+	// and other events, such as a copy, are scanned.
+	if got := selectEvents(events, types); !reflect.DeepEqual(got, want) {
+		t.Errorf("selectEvents on the loaded events returned %d events; want %d", len(got), len(want))
+	}
+	copied := append([]*trace.Event(nil), events...)
+	if got := selectEvents(copied, types); !reflect.DeepEqual(got, want) {
+		t.Errorf("selectEvents on copied events returned %d events; want %d", len(got), len(want))
+	}
+}
+
+func TestWaitProfile(t *testing.T) {
+	events := []*trace.Event{
+		blockEvent(1, 0, 10, 1, "main.f"),
+		{
+			Type:  trace.EvGoSysCall,
+			G:     1,
+			Ts:    20,
+			StkID: 2,
+			Stk:   []*trace.Frame{{PC: 2, Fn: "syscall.Read"}},
+			Link:  &trace.Event{Type: trace.EvGoSysExit, Ts: 50},
+		},
+	}
+	p, err := computeProfile(profileWait, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, s := range p.Sample {
+		got[s.Label["reason"][0]] += s.Value[1]
+	}
+	if want := map[string]int64{"block": 10, "syscall": 30}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got delay by reason %v; want %v", got, want)
+	}
+
+	// The blocksched profile leaves out syscalls.
+	p, err = computeProfile(profileBlockSched, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	got = make(map[string]int64)
+	for _, s := range p.Sample {
+		got[s.Label["reason"][0]] += s.Value[1]
+	}
+	if want := map[string]int64{"block": 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got blocksched delay by reason %v; want %v", got, want)
+	}
+}
+
+func TestCollapseRecursion(t *testing.T) {
+	var stk []*trace.Frame
+	for i, fn := range []string{"main.walk", "main.walk", "main.walk", "main.visit", "main.walk", "main.main"} {
+		stk = append(stk, &trace.Frame{PC: uint64(i + 1), Fn: fn})
+	}
+	var got []string
+	for _, frame := range collapseRecursion(stk) {
+		got = append(got, frame.Fn)
+	}
+	if want := []string{"main.walk", "main.visit", "main.walk", "main.main"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got stack %v; want %v", got, want)
+	}
+}
+
+func TestTruncateStack(t *testing.T) {
+	var stk []*trace.Frame
+	for i, pc := range []uint64{1, 2, 2, 3, 4} { // main.c is inlined in main.b.
+		stk = append(stk, &trace.Frame{PC: pc, Fn: []string{"main.a", "main.c", "main.b", "main.d", "main.main"}[i]})
+	}
+	for _, tc := range []struct {
+		n    int
+		want []string
+	}{
+		{1, []string{"main.a", "[truncated]"}},
+		{2, []string{"main.a", "main.c", "main.b", "[truncated]"}},
+		{3, []string{"main.a", "main.c", "main.b", "[truncated]"}},
+		{4, []string{"main.a", "main.c", "main.b", "main.d", "[truncated]"}},
+		{5, []string{"main.a", "main.c", "main.b", "main.d", "main.main"}},
+		{10, []string{"main.a", "main.c", "main.b", "main.d", "main.main"}},
+	} {
+		var got []string
+		for _, frame := range truncateStack(stk, tc.n) {
+			got = append(got, frame.Fn)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("truncateStack(%d) = %v; want %v", tc.n, got, tc.want)
+		}
+	}
+
+	// A recursive call through one call site repeats the same frame.
+	var rec []*trace.Frame
+	for i := 0; i < 100; i++ {
+		rec = append(rec, &trace.Frame{PC: 1, Fn: "main.r", Line: 20})
+	}
+	if got := truncateStack(rec, 3); len(got) != 4 || got[3] != truncatedFrame {
+		t.Errorf("truncateStack(3) of a recursive stack kept %d frames; want 3 and truncatedFrame", len(got))
+	}
+}
+
+func TestBuildProfileDeterministic(t *testing.T) {
+	var events []*trace.Event
+	for i := 1; i <= 50; i++ {
+		events = append(events, blockEvent(uint64(i), 0, int64(i), uint64(i), fmt.Sprintf("main.f%d", i)))
+	}
+	var first []byte
+	for i := 0; i < 5; i++ {
+		p, err := computeProfile(profileBlock, events, nil, &pprofOptions{byLabel: true})
+		if err != nil {
+			t.Fatalf("computeProfile failed: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := p.WriteUncompressed(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = buf.Bytes()
+		} else if !bytes.Equal(buf.Bytes(), first) {
+			t.Fatalf("profile %d differs from the first one", i)
+		}
+	}
+}
+
+func TestBuildProfileMapping(t *testing.T) {
+	prof := newPprofRecords(nil)
+	prof.add(&trace.Event{}, 1, []*trace.Frame{{PC: 1, Fn: "main.f"}}, 10)
+	if p := buildProfile(prof); len(p.Mapping) != 0 {
+		t.Errorf("got mappings %v without a program binary; want none", p.Mapping)
+	}
+
+	defer func(name string) { programBinary = name }(programBinary)
+	programBinary = "prog.test"
+	p := buildProfile(prof)
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+	if len(p.Mapping) != 1 || p.Mapping[0].File != programBinary {
+		t.Fatalf("got mappings %v; want one for %s", p.Mapping, programBinary)
+	}
+	if loc := p.Location[0]; loc.Mapping != p.Mapping[0] {
+		t.Errorf("location %v is not in the program mapping", loc)
+	}
+}
+
+func TestWriteJSONProfile(t *testing.T) {
+	prof := newPprofRecords(nil)
+	prof.add(&trace.Event{}, 1, []*trace.Frame{{PC: 1, Fn: "main.f", File: "f.go", Line: 3}, {PC: 2, Fn: "main.main", File: "main.go", Line: 7}}, 30)
+	var buf bytes.Buffer
+	if err := writeJSONProfile(&buf, buildProfile(prof)); err != nil {
+		t.Fatalf("writeJSONProfile failed: %v", err)
+	}
+	var got jsonProfile
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode %s: %v", buf.Bytes(), err)
+	}
+	got.Comments = nil // see TestProfileComments.
+	want := jsonProfile{
+		Unit: "nanoseconds",
+		Samples: []jsonSample{{
+			Stack: []jsonFrame{{"main.f", "f.go", 3}, {"main.main", "main.go", 7}},
+			Count: 1,
+			Delay: 30,
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestSchedReasons(t *testing.T) {
+	parent := []*trace.Frame{{PC: 1, Fn: "main.main"}}
+	events := []*trace.Event{
+		{
+			Type:  trace.EvGoCreate,
+			G:     1,
+			Ts:    0,
+			StkID: 1,
+			Stk:   parent,
+			Args:  [3]uint64{2},
+			Link:  &trace.Event{Type: trace.EvGoStart, G: 2, Ts: 10},
+		},
+		{
+			Type:  trace.EvGoUnblock,
+			G:     1,
+			Ts:    20,
+			StkID: 2,
+			Stk:   []*trace.Frame{{PC: 2, Fn: "main.wake"}},
+			Args:  [3]uint64{2},
+			Link:  &trace.Event{Type: trace.EvGoStart, G: 2, Ts: 50},
+		},
+	}
+	p, err := computeProfile(profileSched, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, s := range p.Sample {
+		got[s.Label["reason"][0]+" "+s.Location[0].Line[0].Function.Name] = s.Value[1]
+	}
+	if want := map[string]int64{"create main.main": 10, "unblock main.wake": 30}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got delay by reason and stack %v; want %v", got, want)
+	}
+}
+
+func TestDurationSummary(t *testing.T) {
+	var durations []time.Duration
+	for i := 100; i >= 1; i-- {
+		durations = append(durations, time.Duration(i)*time.Millisecond)
+	}
+	want := "summary: count=100 p50=50ms p90=90ms p99=99ms max=100ms"
+	if got := durationSummary(durations); got != want {
+		t.Errorf("durationSummary = %q; want %q", got, want)
+	}
+	if got, want := durationSummary(nil), "summary: count=0 p50=0s p90=0s p99=0s max=0s"; got != want {
+		t.Errorf("durationSummary(nil) = %q; want %q", got, want)
+	}
+}
+
+func TestDroppedEvents(t *testing.T) {
+	unattributed := blockEvent(2, 0, int64(time.Millisecond), 0, "")
+	unattributed.Stk = nil
+	events := []*trace.Event{
+		blockEvent(1, 0, int64(3*time.Millisecond), 1, "main.f"),
+		unattributed,
+	}
+	p, err := computeProfile(profileBlock, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 {
+		t.Errorf("got %d samples; want 1", len(p.Sample))
+	}
+	want := "dropped: 1 events without stack, 1ms (25.00% of the total)"
+	if got := p.Comments[len(p.Comments)-1]; got != want {
+		t.Errorf("got comment %q; want %q", got, want)
+	}
+}
+
+func TestSkewedEvents(t *testing.T) {
+	if d := pprofOverlappingDuration(nil, blockEvent(1, 10, 5, 1, "main.f")); d != 0 {
+		t.Errorf("pprofOverlappingDuration = %v for an event ending before it starts; want 0", d)
+	}
+	events := []*trace.Event{
+		blockEvent(1, 0, 10, 1, "main.f"),
+		blockEvent(2, 10, 5, 2, "main.g"),
+	}
+	p, err := computeProfile(profileBlock, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 {
+		t.Errorf("got %d samples; want 1", len(p.Sample))
+	}
+	want := "skewed: 1 events ending before they start"
+	if got := p.Comments[len(p.Comments)-1]; got != want {
+		t.Errorf("got comment %q; want %q", got, want)
+	}
+}
+
+func TestByGoroutine(t *testing.T) {
+	events := []*trace.Event{
+		blockEvent(1, 0, 10, 1, "main.f"),
+		blockEvent(1, 20, 50, 2, "main.g"),
+		blockEvent(2, 0, 5, 1, "main.f"),
+	}
+	p, err := computeProfile(profileBlock, events, nil, &pprofOptions{by: "goroutine"})
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, s := range p.Sample {
+		if len(s.Location) != 1 {
+			t.Errorf("got %d locations; want a single one", len(s.Location))
+			continue
+		}
+		got[s.Location[0].Line[0].Function.Name] = s.Value[1]
+	}
+	if want := map[string]int64{"goroutine 1": 40, "goroutine 2": 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got delay by goroutine %v; want %v", got, want)
+	}
+}
+
+func TestByGoroutineType(t *testing.T) {
+	stk := []*trace.Frame{{PC: 10, Fn: "main.worker"}}
+	events := []*trace.Event{
+		{Type: trace.EvGoCreate, Ts: 0, Args: [3]uint64{1}},
+		{Type: trace.EvGoCreate, Ts: 0, Args: [3]uint64{2}},
+		{Type: trace.EvGoStart, G: 1, Ts: 0, StkID: 1, Stk: stk},
+		{Type: trace.EvGoStart, G: 2, Ts: 0, StkID: 1, Stk: stk},
+		blockEvent(1, 10, 20, 2, "main.f"),
+		blockEvent(2, 10, 40, 3, "main.g"),
+	}
+	defer fakeLoaderData(trace.ParseResult{Events: events})()
+	p, err := generateProfile(pprofByGoroutine(computePprofKind(profileBlock)), httptest.NewRequest("GET", "/block?by=type", nil))
+	if err != nil {
+		t.Fatalf("generateProfile failed: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, s := range p.Sample {
+		got[s.Location[0].Line[0].Function.Name] += s.Value[1]
+	}
+	if want := map[string]int64{"main.worker": 40}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got delay by goroutine type %v; want %v", got, want)
+	}
+
+	// Without the goroutines of the trace, their types are unknown.
+	p, err = computeProfile(profileBlock, events, nil, &pprofOptions{by: "type"})
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 || p.Sample[0].Location[0].Line[0].Function.Name != "unknown goroutine type" {
+		t.Errorf("got samples %v; want a single one of unknown goroutine type", p.Sample)
+	}
+}
+
+func TestByGoroutineLabel(t *testing.T) {
+	// Goroutine 1 makes goroutine 2 runnable: both the aggregation and the
+	// goroutine label are for goroutine 2, which waits to be scheduled.
+	stk := []*trace.Frame{{PC: 1, Fn: "main.f"}}
+	events := []*trace.Event{
+		{Type: trace.EvGoUnblock, G: 1, P: 3, Ts: 0, StkID: 1, Stk: stk, Args: [3]uint64{2},
+			Link: &trace.Event{Type: trace.EvGoStart, G: 2, Ts: 10}},
+	}
+	p, err := computeProfile(profileSched, events, nil, &pprofOptions{by: "goroutine", byLabel: true})
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 {
+		t.Fatalf("got %d samples; want 1", len(p.Sample))
+	}
+	s := p.Sample[0]
+	if fn := s.Location[0].Line[0].Function.Name; fn != "goroutine 2" {
+		t.Errorf("got sample for %q; want goroutine 2", fn)
+	}
+	if want := map[string][]int64{"goroutine": {2}, "p": {3}}; !reflect.DeepEqual(s.NumLabel, want) {
+		t.Errorf("got labels %v; want %v", s.NumLabel, want)
+	}
+}
+
+func TestByUnblocker(t *testing.T) {
+	unlocked := blockEvent(1, 0, 10, 1, "main.f")
+	unlocked.Link.G, unlocked.Link.StkID = 3, 10
+	unlocked.Link.Stk = []*trace.Frame{{PC: 10, Fn: "sync.(*Mutex).Unlock"}, {PC: 11, Fn: "main.holder"}}
+	events := []*trace.Event{
+		unlocked,
+		blockEvent(2, 0, 5, 1, "main.f"), // unblocked without a stack.
+	}
+	p, err := computeProfile(profileBlock, events, nil, &pprofOptions{by: "unblocker"})
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, s := range p.Sample {
+		got[s.Location[len(s.Location)-1].Line[0].Function.Name] += s.Value[1]
+	}
+	if want := map[string]int64{"main.holder": 10, "main.f": 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got delay by outermost function %v; want %v", got, want)
+	}
+}
+
+func TestCustomProfile(t *testing.T) {
+	for _, tc := range []struct {
+		types string
+		want  []byte
+		ok    bool
+	}{
+		{"", nil, false},
+		{"12", []byte{12}, true},
+		{"12, 13", []byte{12, 13}, true},
+		{"0", nil, false},
+		{fmt.Sprint(trace.EvCount), nil, false},
+		{"300", nil, false},
+		{"x", nil, false},
+	} {
+		got, err := customEventTypes(tc.types)
+		if (err == nil) != tc.ok || !bytes.Equal(got, tc.want) {
+			t.Errorf("customEventTypes(%q) = %v, %v; want %v, ok=%v", tc.types, got, err, tc.want, tc.ok)
+		}
+	}
+	for _, url := range []string{"/custom", "/custom?types=300"} {
+		err := pprofCustom(ioutil.Discard, httptest.NewRequest("GET", url, nil))
+		if _, ok := err.(*paramError); !ok {
+			t.Errorf("%s: got error %#v; want a parameter error", url, err)
+		}
+	}
+
+	custom := blockEvent(1, 0, 100, 1, "main.f")
+	custom.Type = trace.EvGoBlockNet
+	events := []*trace.Event{custom, blockEvent(1, 0, 50, 2, "main.g")}
+	k := &pprofKind{records: pprofLinkedRecords, types: []byte{trace.EvGoBlockNet}}
+	p, err := computeKindProfile("custom", k, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeKindProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 || p.Sample[0].Value[1] != 100 {
+		t.Errorf("got samples %v; want one with a delay of 100", p.Sample)
+	}
+}
+
+func TestTimeBucket(t *testing.T) {
+	for _, tc := range []struct {
+		ts, first, last int64
+		n, want         int
+	}{
+		{0, 0, 100, 4, 0},
+		{24, 0, 100, 4, 0},
+		{25, 0, 100, 4, 1},
+		{99, 0, 100, 4, 3},
+		{100, 0, 100, 4, 3},
+		{150, 100, 200, 2, 1},
+		{50, 100, 200, 2, 0},
+		{10, 0, 0, 4, 0},
+	} {
+		if got := timeBucket(tc.ts, tc.first, tc.last, tc.n); got != tc.want {
+			t.Errorf("timeBucket(%d, %d, %d, %d) = %d; want %d", tc.ts, tc.first, tc.last, tc.n, got, tc.want)
+		}
+	}
+
+	events := []*trace.Event{blockEvent(1, 0, 100, 1, "main.f")}
+	p, err := computeProfile(profileBlock, events, nil, &pprofOptions{buckets: 4})
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 || !reflect.DeepEqual(p.Sample[0].NumLabel["timebucket"], []int64{0}) {
+		t.Errorf("got samples %v; want one labeled with timebucket 0", p.Sample)
+	}
+}
+
+func TestCallgrindProfile(t *testing.T) {
+	ev := blockEvent(1, 0, 100, 1, "main.f")
+	ev.Stk = []*trace.Frame{
+		{PC: 1, Fn: "main.f", File: "a.go", Line: 10},
+		{PC: 2, Fn: "main.main", File: "a.go", Line: 20},
+	}
+	p, err := computeProfile(profileBlock, []*trace.Event{ev}, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := writeCallgrindProfile(&buf, p); err != nil {
+		t.Fatalf("writeCallgrindProfile failed: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"events: delay\nsummary: 100\n",
+		"\nfl=(1) a.go\nfn=(1) main.f\n10 100\n",
+		"\nfl=(1)\nfn=(2) main.main\ncfl=(1)\ncfn=(1)\ncalls=1 10\n20 100\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("callgrind profile does not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestIdleRecords(t *testing.T) {
+	block := blockEvent(1, 10, 200, 1, "main.f")
+	events := []*trace.Event{
+		{Type: trace.EvGoStart, P: 0, G: 1, Ts: 5},
+		block,
+		{Type: trace.EvProcStop, P: 0, Ts: 20},
+		{Type: trace.EvProcStop, P: 1, Ts: 30}, // no goroutine ran on P 1.
+		{Type: trace.EvProcStart, P: 1, Ts: 40},
+		{Type: trace.EvProcStart, P: 0, Ts: 70},
+		{Type: trace.EvProcStop, P: 0, Ts: 100}, // idle until the end.
+	}
+	p, err := computeProfile(profileIdle, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 {
+		t.Fatalf("got %d samples; want 1", len(p.Sample))
+	}
+	s := p.Sample[0]
+	if s.Value[1] != 50 || s.Location[0].Line[0].Function.Name != "main.f" {
+		t.Errorf("got delay %d at %s; want 50 at main.f", s.Value[1], s.Location[0].Line[0].Function.Name)
+	}
+}
+
+func TestDNSProfile(t *testing.T) {
+	netEvent := func(begin, end int64, stkID uint64, fns ...string) *trace.Event {
+		ev := blockEvent(1, begin, end, stkID, fns[0])
+		ev.Type = trace.EvGoBlockNet
+		ev.Stk = nil
+		for i, fn := range fns {
+			ev.Stk = append(ev.Stk, &trace.Frame{PC: stkID*10 + uint64(i), Fn: fn})
+		}
+		return ev
+	}
+	events := []*trace.Event{
+		netEvent(0, 100, 1, "internal/poll.(*pollDesc).waitRead", "net.(*conn).Read", "net.dnsPacketRoundTrip", "net.(*Resolver).exchange"),
+		netEvent(0, 30, 2, "internal/poll.(*pollDesc).waitRead", "net.(*conn).Read", "net/http.(*persistConn).Read"),
+	}
+	p, err := computeProfile(profileDNS, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 || p.Sample[0].Value[1] != 100 {
+		t.Errorf("got samples %v; want one with a delay of 100", p.Sample)
+	}
+}
+
+func TestCSVProfile(t *testing.T) {
+	events := []*trace.Event{
+		blockEvent(1, 0, 100, 1, "main.f"),
+		blockEvent(2, 0, 50, 1, "main.f"),
+		blockEvent(3, 0, 30, 2, "main.g"),
+	}
+	p, err := computeProfile(profileBlock, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := writeCSVProfile(&buf, p); err != nil {
+		t.Fatalf("writeCSVProfile failed: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to read csv: %v", err)
+	}
+	if want := []string{"leaf", "stack", "contentions", "delay_nanoseconds"}; len(rows) == 0 || !reflect.DeepEqual(rows[0], want) {
+		t.Fatalf("got rows %v; want the header %v first", rows, want)
+	}
+	got := make(map[string][]string)
+	for _, row := range rows[1:] {
+		got[row[0]] = []string{row[2], row[3]}
+	}
+	want := map[string][]string{"main.f": {"2", "150"}, "main.g": {"1", "30"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got rows %v; want %v", got, want)
+	}
+	if rows[1][1] == rows[2][1] {
+		t.Errorf("the stacks of main.f and main.g have the same hash %s", rows[1][1])
+	}
+}
+
+func TestAverageDelay(t *testing.T) {
+	events := []*trace.Event{
+		blockEvent(1, 0, 100, 1, "main.f"),
+		blockEvent(2, 0, 50, 1, "main.f"),
+	}
+	p, err := computeProfile(profileBlock, events, nil, &pprofOptions{avg: true, unit: delayUnits["ns"]})
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.SampleType) != 3 || p.SampleType[2].Type != "avgdelay" || p.DefaultSampleType != "delay" {
+		t.Fatalf("got sample types %v, default %q; want avgdelay third, delay by default", p.SampleType, p.DefaultSampleType)
+	}
+	if len(p.Sample) != 1 || !reflect.DeepEqual(p.Sample[0].Value, []int64{2, 150, 75}) {
+		t.Errorf("got samples %v; want one with values [2 150 75]", p.Sample)
+	}
+	if idx := defaultSampleIndex(p); idx != 1 {
+		t.Errorf("defaultSampleIndex = %d; want 1", idx)
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Errorf("invalid profile: %v", err)
+	}
+
+	// Records without events, as from the difference of profiles, have no average.
+	prof := newPprofRecords(&pprofOptions{avg: true})
+	prof.recs[recordKey{stkID: 1}] = Record{stk: []*trace.Frame{{PC: 1, Fn: "main.f"}}, time: 10}
+	if p := buildProfile(prof); !reflect.DeepEqual(p.Sample[0].Value, []int64{0, 10, 0}) {
+		t.Errorf("got values %v for a record without events; want [0 10 0]", p.Sample[0].Value)
+	}
+}
+
+func TestWriteIntervals(t *testing.T) {
+	for _, tc := range []struct {
+		gToIntervals map[uint64][]interval
+		want         string
+	}{
+		{nil, `{"all":true,"goroutines":{}}`},
+		{map[uint64][]interval{}, `{"all":false,"goroutines":{}}`},
+		{map[uint64][]interval{7: {{10, 20}, {30, 40}}}, `{"all":false,"goroutines":{"7":[{"begin":10,"end":20},{"begin":30,"end":40}]}}`},
+	} {
+		rec := httptest.NewRecorder()
+		serveIntervals(func(w io.Writer, r *http.Request) error {
+			return writeIntervals(w, tc.gToIntervals, nil, nil)
+		})(rec, httptest.NewRequest("GET", "/intervals", nil))
+		if got := strings.TrimSpace(rec.Body.String()); got != tc.want {
+			t.Errorf("intervals %v: got %s; want %s", tc.gToIntervals, got, tc.want)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("intervals %v: got Content-Type %q; want application/json", tc.gToIntervals, ct)
+		}
+	}
+}
+
+func TestIntervalsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		url     string
+		status  int
+	}{
+		{serveIntervals(pprofByGoroutine(writeIntervals)), "/intervals?bylabel=x", http.StatusBadRequest},
+		{serveIntervals(pprofBySpan(writeIntervals)), "/spanintervals?latmin=x", http.StatusBadRequest},
+		{serveIntervals(pprofBySpan(writeIntervals)), "/spanintervals?unit=x", http.StatusBadRequest},
+		{serveIntervals(func(w io.Writer, r *http.Request) error {
+			return fmt.Errorf("failed")
+		}), "/intervals", http.StatusInternalServerError},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest("GET", tc.url, nil))
+		if rec.Code != tc.status {
+			t.Errorf("%s: got status %d; want %d (%s)", tc.url, rec.Code, tc.status, strings.TrimSpace(rec.Body.String()))
+		}
+	}
+}
+
+func TestLifetimeProfile(t *testing.T) {
+	stk1 := []*trace.Frame{{PC: 1, Fn: "main.serve"}}
+	stk2 := []*trace.Frame{{PC: 2, Fn: "main.leak"}}
+	events := []*trace.Event{
+		{Type: trace.EvGoCreate, G: 1, Ts: 0, StkID: 1, Stk: stk1, Args: [3]uint64{2, 0}},
+		{Type: trace.EvGoCreate, G: 1, Ts: 10, StkID: 1, Stk: stk1, Args: [3]uint64{3, 0}},
+		{Type: trace.EvGoCreate, G: 1, Ts: 20, StkID: 2, Stk: stk2, Args: [3]uint64{4, 0}},
+		{Type: trace.EvGoEnd, G: 2, Ts: 30},
+		{Type: trace.EvGoEnd, G: 3, Ts: 60},
+		{Type: trace.EvGoBlock, G: 4, Ts: 100},
+	}
+	parseTrace() // fool loader.once.
+	defer func(res trace.ParseResult) { loader.res = res }(loader.res)
+	loader.res = trace.ParseResult{Events: events} // for the trace end time.
+	p, err := computeProfile(profileLifetime, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	type sample struct {
+		fn, state string
+		n, delay  int64
+	}
+	var got []sample
+	for _, s := range p.Sample {
+		var state string
+		if l := s.Label["state"]; len(l) > 0 {
+			state = l[0]
+		}
+		got = append(got, sample{s.Location[0].Line[0].Function.Name, state, s.Value[0], s.Value[1]})
+	}
+	want := []sample{
+		{"main.serve", "", 2, 80},
+		{"main.leak", "unfinished", 1, 80},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %+v; want %+v", got, want)
+	}
+}
+
+func TestSchedWaker(t *testing.T) {
+	unlock := []*trace.Frame{{PC: 1, Fn: "runtime.semrelease"}, {PC: 2, Fn: "sync.(*Mutex).Unlock"}, {PC: 3, Fn: "main.f"}}
+	start := func(ts int64) *trace.Event { return &trace.Event{Type: trace.EvGoStart, Ts: ts} }
+	events := []*trace.Event{
+		{Type: trace.EvGoUnblock, G: 1, P: 0, Ts: 0, StkID: 1, Stk: unlock, Args: [3]uint64{2}, Link: start(10)},
+		{Type: trace.EvGoUnblock, P: trace.NetpollP, Ts: 0, Args: [3]uint64{3}, Link: start(20)},
+		{Type: trace.EvGoUnblock, P: 1, Ts: 0, Args: [3]uint64{4}, Link: start(40)},
+	}
+	for _, tc := range []struct {
+		waker bool
+		want  map[string]int64 // waker to delay
+	}{
+		{false, map[string]int64{"": 10}},
+		{true, map[string]int64{"sync.(*Mutex).Unlock": 10, "network poller": 20, "scheduler": 40}},
+	} {
+		p, err := computeProfile(profileSched, events, nil, &pprofOptions{waker: tc.waker})
+		if err != nil {
+			t.Fatalf("computeProfile failed: %v", err)
+		}
+		got := make(map[string]int64)
+		for _, s := range p.Sample {
+			var waker string
+			if l := s.Label["waker"]; len(l) > 0 {
+				waker = l[0]
+			}
+			got[waker] += s.Value[1]
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("waker=%v: got delays %v; want %v", tc.waker, got, tc.want)
+		}
+	}
+}
+
+func TestSchedIdleP(t *testing.T) {
+	stk := []*trace.Frame{{PC: 1, Fn: "main.f"}}
+	start := func(ts int64) *trace.Event { return &trace.Event{Type: trace.EvGoStart, Ts: ts} }
+	events := []*trace.Event{
+		{Type: trace.EvGomaxprocs, Ts: 0, Args: [3]uint64{2}},
+		{Type: trace.EvProcStart, P: 0, Ts: 0},
+		{Type: trace.EvProcStart, P: 1, Ts: 10},
+		// All Ps are busy from 10 to 50.
+		{Type: trace.EvGoUnblock, G: 1, Ts: 20, StkID: 1, Stk: stk, Args: [3]uint64{2}, Link: start(30)},
+		{Type: trace.EvGoUnblock, G: 1, Ts: 40, StkID: 1, Stk: stk, Args: [3]uint64{3}, Link: start(100)},
+		{Type: trace.EvProcStop, P: 1, Ts: 50},
+		{Type: trace.EvGoUnblock, G: 1, Ts: 60, StkID: 1, Stk: stk, Args: [3]uint64{4}, Link: start(70)},
+	}
+	p, err := computeProfile(profileSched, events, nil, &pprofOptions{idleP: true})
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, s := range p.Sample {
+		got[s.Label["idlep"][0]] += s.Value[1]
+	}
+	if want := map[string]int64{"no": 10, "yes": 70}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got delays by idlep label %v; want %v", got, want)
+	}
+}
+
+func TestPprofFilterProcs(t *testing.T) {
+	events := []*trace.Event{
+		{Type: trace.EvGomaxprocs, P: 0, Ts: 0, Args: [3]uint64{2}},
+		{Type: trace.EvProcStart, P: 0, Ts: 0},
+		{Type: trace.EvProcStart, P: 1, Ts: 10},
+		{Type: trace.EvGoBlockNet, P: 0, G: 1, Ts: 20},
+		{Type: trace.EvGoBlockNet, P: 1, G: 2, Ts: 30},
+		{Type: trace.EvProcStop, P: 1, Ts: 40},
+		{Type: trace.EvGoUnblock, P: 2, G: 3, Ts: 50},
+	}
+	for _, tc := range []struct {
+		url  string
+		want []int64 // timestamps of the kept events.
+	}{
+		{"/io", []int64{0, 0, 10, 20, 30, 40, 50}},
+		{"/io?p=0", []int64{0, 0, 10, 20, 40}},
+		{"/io?p=1,2", []int64{0, 0, 10, 30, 40, 50}},
+		{"/io?p=3", []int64{0, 0, 10, 40}},
+	} {
+		res, err := pprofFilterProcs(httptest.NewRequest("GET", tc.url, nil), events)
+		if err != nil {
+			t.Errorf("%s: pprofFilterProcs failed: %v", tc.url, err)
+			continue
+		}
+		var got []int64
+		for _, ev := range res {
+			got = append(got, ev.Ts)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got events at %v; want %v", tc.url, got, tc.want)
+		}
+	}
+	if _, err := pprofFilterProcs(httptest.NewRequest("GET", "/io?p=x", nil), events); err == nil {
+		t.Errorf("pprofFilterProcs succeeded with an invalid processor id")
+	} else if _, ok := err.(*paramError); !ok {
+		t.Errorf("got error %#v for an invalid processor id; want a parameter error", err)
+	}
+}
+
+func TestComputeProfileKinds(t *testing.T) {
+	events := []*trace.Event{blockEvent(1, 0, 10, 1, "main.f")}
+	for name, k := range profileKinds {
+		p, err := computeProfile(k.kind, events, nil, nil)
+		if err != nil {
+			t.Errorf("%s: computeProfile failed: %v", name, err)
+			continue
+		}
+		if want := "kind: " + name; len(p.Comments) < 2 || p.Comments[1] != want {
+			t.Errorf("%s: got comments %q; want %q", name, p.Comments, want)
+		}
+	}
+	if _, err := computeProfile(profileKind(-1), events, nil, nil); err == nil || !strings.Contains(err.Error(), "unknown profile kind") {
+		t.Errorf("unknown kind: got error %v; want unknown profile kind", err)
+	}
+}
+
+func TestPprofExecRecords(t *testing.T) {
+	stkF := []*trace.Frame{{PC: 1, Fn: "main.f"}}
+	stkG := []*trace.Frame{{PC: 2, Fn: "main.g"}}
+	stop := &trace.Event{Type: trace.EvGoSched, Ts: 30, G: 1, StkID: 1, Stk: stkF}
+	events := []*trace.Event{
+		{Type: trace.EvGoStart, Ts: 10, G: 1, Link: stop},
+		// Goroutine 2 is still running at the end of the trace.
+		{Type: trace.EvGoStart, Ts: 20, G: 2, StkID: 2, Stk: stkG},
+		stop,
+		{Type: trace.EvGoSched, Ts: 100, G: 3},
+	}
+	parseTrace() // fool loader.once.
+	defer func(res trace.ParseResult, traces []trace.ParseResult) {
+		loader.res, loader.traces = res, traces
+	}(loader.res, loader.traces)
+	loader.res = trace.ParseResult{Events: events}
+	loader.traces = nil
+
+	p, err := computeProfile(profileExec, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, s := range p.Sample {
+		got[s.Location[0].Line[0].Function.Name] += s.Value[1]
+	}
+	// main.f ran until its stop, main.g until the last event.
+	if want := map[string]int64{"main.f": 20, "main.g": 80}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got running time by function %v; want %v", got, want)
+	}
+}
+
+func TestPprofRestrictTimeRange(t *testing.T) {
+	stk := []*trace.Frame{{PC: 1, Fn: "main.f"}}
+	events := []*trace.Event{
+		{Type: trace.EvGoCreate, Ts: 1000, G: 0, Args: [3]uint64{1}},
+		{Type: trace.EvGoCreate, Ts: 1000, G: 0, Args: [3]uint64{2}},
+		{Type: trace.EvGoStart, Ts: 1100, G: 1, StkID: 1, Stk: stk},
+		{Type: trace.EvGoStart, Ts: 1900, G: 2, StkID: 1, Stk: stk},
+		{Type: trace.EvGoSched, Ts: 2000, G: 2},
+	}
+	defer fakeLoaderData(trace.ParseResult{Events: events})()
+
+	gToIntervals := map[uint64][]interval{
+		1: {{1100, 1200}, {1300, 1500}},
+		2: {{1900, 2000}},
+	}
+	for _, tc := range []struct {
+		url  string
+		want map[uint64][]interval
+		err  string
+	}{
+		{"/block", gToIntervals, ""},
+		{"/block?start=150&end=400", map[uint64][]interval{1: {{1150, 1200}, {1300, 1400}}}, ""},
+		// Intervals touching the range at its start or end are left out.
+		{"/block?start=200&end=300", map[uint64][]interval{}, ""},
+		{"/block?start=200", map[uint64][]interval{1: {{1300, 1500}}, 2: {{1900, 2000}}}, ""},
+		{"/block?end=200", map[uint64][]interval{1: {{1100, 1200}}}, ""},
+		{"/block?start=0&end=1000", gToIntervals, ""},
+		{"/block?start=x", nil, "invalid start time"},
+		{"/block?end=x", nil, "invalid end time"},
+		{"/block?start=300&end=200", nil, "invalid time range"},
+	} {
+		got, err := pprofRestrictTimeRange(httptest.NewRequest("GET", tc.url, nil), gToIntervals, events)
+		switch {
+		case tc.err != "":
+			if _, ok := err.(*paramError); !ok || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: got error %#v; want a parameter error %q", tc.url, err, tc.err)
+			}
+		case err != nil:
+			t.Errorf("%s: pprofRestrictTimeRange failed: %v", tc.url, err)
+		case !reflect.DeepEqual(got, tc.want):
+			t.Errorf("%s: got %v; want %v", tc.url, got, tc.want)
+		}
+	}
+
+	// Without goroutine intervals, all goroutines get the range.
+	got, err := pprofRestrictTimeRange(httptest.NewRequest("GET", "/block?start=100&end=200", nil), nil, events)
+	if err != nil {
+		t.Fatalf("pprofRestrictTimeRange failed: %v", err)
+	}
+	if want := map[uint64][]interval{1: {{1100, 1200}}, 2: {{1100, 1200}}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestBlockReasons(t *testing.T) {
+	// One event of each type, each with the stack of its own function.
+	fns := map[byte]string{
+		trace.EvGoBlockSend:   "main.send",
+		trace.EvGoBlockRecv:   "main.recv",
+		trace.EvGoBlockSelect: "main.select",
+		trace.EvGoBlockSync:   "main.lock",
+		trace.EvGoBlockCond:   "main.wait",
+	}
+	var events []*trace.Event
+	for typ, fn := range fns {
+		ev := blockEvent(1, 0, 10, uint64(typ), fn)
+		ev.Type = typ
+		events = append(events, ev)
+	}
+	for _, tc := range []struct {
+		reason string
+		want   []string
+	}{
+		{"send", []string{"main.send"}},
+		{"recv", []string{"main.recv"}},
+		{"select", []string{"main.select"}},
+		{"sync", []string{"main.lock"}},
+		{"cond", []string{"main.wait"}},
+		{"send,recv", []string{"main.recv", "main.send"}},
+		{"", []string{"main.lock", "main.recv", "main.select", "main.send", "main.wait"}},
+	} {
+		opts, err := newPprofOptions(httptest.NewRequest("GET", "/block?reason="+tc.reason, nil))
+		if err != nil {
+			t.Fatalf("reason=%s: newPprofOptions failed: %v", tc.reason, err)
+		}
+		p, err := computeProfile(profileBlock, events, nil, opts)
+		if err != nil {
+			t.Fatalf("reason=%s: computeProfile failed: %v", tc.reason, err)
+		}
+		var got []string
+		for _, s := range p.Sample {
+			got = append(got, s.Location[0].Line[0].Function.Name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("reason=%s: got samples of %v; want %v", tc.reason, got, tc.want)
+		}
+	}
+	if _, err := newPprofOptions(httptest.NewRequest("GET", "/block?reason=mutex", nil)); err == nil {
+		t.Errorf("reason=mutex: newPprofOptions succeeded; want an error")
+	}
+}
+
+func TestPprofGCAssist(t *testing.T) {
+	frames := func(fn string, pc uint64) []*trace.Frame { return []*trace.Frame{{PC: pc, Fn: fn}} }
+	unblock := func(ts int64) *trace.Event { return &trace.Event{Type: trace.EvGoUnblock, Ts: ts} }
+	events := []*trace.Event{
+		{Type: trace.EvGCMarkAssistStart, G: 1, Ts: 0, StkID: 1, Stk: frames("main.f", 1),
+			Link: &trace.Event{Type: trace.EvGCMarkAssistDone, Ts: 50}},
+		// Goroutine 2 blocks outside of a traced mark assist.
+		{Type: trace.EvGoBlockGC, G: 2, Ts: 0, StkID: 3, Stk: frames("main.g", 3), Link: unblock(40)},
+		// Goroutine 1 blocks within its mark assist, which already covers it.
+		{Type: trace.EvGoBlockGC, G: 1, Ts: 10, StkID: 2, Stk: frames("main.h", 2), Link: unblock(20)},
+	}
+	p, err := computeProfile(profileGCAssist, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, s := range p.Sample {
+		got[s.Location[0].Line[0].Function.Name] += s.Value[1]
+	}
+	if want := map[string]int64{"main.f": 50, "main.g": 40}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got GC assist delay by function %v; want %v", got, want)
+	}
+
+	// GC assist blocking is not synchronization blocking.
+	p, err = computeProfile(profileBlock, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 0 {
+		t.Errorf("got %d samples in the block profile; want none", len(p.Sample))
+	}
+}
+
+func TestPprofGoroutineTypes(t *testing.T) {
+	worker := []*trace.Frame{{PC: 10, Fn: "main.worker"}}
+	serve := []*trace.Frame{{PC: 20, Fn: "main.serve"}}
+	events := []*trace.Event{
+		{Type: trace.EvGoCreate, Ts: 0, Args: [3]uint64{1}},
+		{Type: trace.EvGoCreate, Ts: 0, Args: [3]uint64{2}},
+		{Type: trace.EvGoCreate, Ts: 0, Args: [3]uint64{3}},
+		{Type: trace.EvGoStart, Ts: 10, G: 1, StkID: 1, Stk: worker},
+		{Type: trace.EvGoStart, Ts: 10, G: 2, StkID: 1, Stk: worker},
+		{Type: trace.EvGoStart, Ts: 20, G: 3, StkID: 2, Stk: serve},
+		{Type: trace.EvGoEnd, Ts: 30, G: 1},
+		{Type: trace.EvGoEnd, Ts: 50, G: 2},
+		// Goroutine 3 is still running at the end of the trace.
+		{Type: trace.EvGoSched, Ts: 200, G: 3},
+	}
+	defer fakeLoaderData(trace.ParseResult{Events: events})()
+
+	rec := httptest.NewRecorder()
+	httpGoroutineTypes(rec, httptest.NewRequest("GET", "/goroutinetypes", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q; want application/json", ct)
+	}
+	var got []gtypeSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode goroutine types: %v\n%s", err, rec.Body)
+	}
+	// Sorted by decreasing total lifetime.
+	want := []gtypeSummary{
+		{ID: 20, Name: "main.serve", N: 1, TotalLifetime: 200, AvgLifetime: 200},
+		{ID: 10, Name: "main.worker", N: 2, TotalLifetime: 80, AvgLifetime: 40},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got goroutine types %+v; want %+v", got, want)
+	}
+}
+
+func TestPprofDiffErrors(t *testing.T) {
+	stk := []*trace.Frame{{PC: 1, Fn: "main.f"}}
+	defer fakeLoaderData(trace.ParseResult{Events: []*trace.Event{
+		{Type: trace.EvGoCreate, Ts: 0, Args: [3]uint64{1}},
+		{Type: trace.EvGoStart, G: 1, Ts: 0, StkID: 1, Stk: stk},
+		blockEvent(1, 0, 10, 1, "main.f"),
+	}})()
+	if err := pprofDiff(ioutil.Discard, httptest.NewRequest("GET", "/diff?kind=block&a=0&b=0", nil)); err != nil {
+		t.Errorf("pprofDiff failed: %v", err)
+	}
+	for _, url := range []string{
+		"/diff?kind=x&a=0&b=0",
+		"/diff?kind=block&a=0&b=1",
+		"/diff?kind=block&a=x.out&b=0",
+		"/diff?kind=block&a=0&b=0&bylabel=x",
+	} {
+		err := pprofDiff(ioutil.Discard, httptest.NewRequest("GET", url, nil))
+		if _, ok := err.(*paramError); !ok {
+			t.Errorf("%s: got error %#v; want a parameter error", url, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Serving of profiles through the pprof web interface, run in-process.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/driver"
+	"github.com/google/pprof/profile"
+)
+
+func init() {
+	http.HandleFunc("/pprofui/", servePprofUI)
+}
+
+// maxPprofUIs is the number of profiles kept for the pprof web interface.
+// When more are opened, the oldest ones are discarded.
+const maxPprofUIs = 16
+
+// pprofUIs holds the handlers of the pprof web interface for the profiles
+// opened with format=flamegraph, keyed by the id in their /pprofui/ paths.
+var pprofUIs struct {
+	sync.Mutex
+	next     int
+	handlers map[int]map[string]http.Handler
+}
+
+// startPprofUI starts the pprof web interface for the profile p
+// and returns the path of its flame graph view.
+func startPprofUI(p *profile.Profile) (string, error) {
+	var handlers map[string]http.Handler
+	err := driver.PProf(&driver.Options{
+		Flagset: newPprofUIFlags("-http=localhost:0", "-symbolize=none", "profile"),
+		Fetch:   pprofUIFetcher{p},
+		UI:      pprofUISilent{},
+		HTTPServer: func(args *driver.HTTPServerArgs) error {
+			handlers = args.Handlers
+			return nil
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if handlers == nil {
+		return "", fmt.Errorf("pprof did not start its web interface")
+	}
+
+	pprofUIs.Lock()
+	defer pprofUIs.Unlock()
+	if pprofUIs.handlers == nil {
+		pprofUIs.handlers = make(map[int]map[string]http.Handler)
+	}
+	id := pprofUIs.next
+	pprofUIs.next++
+	pprofUIs.handlers[id] = handlers
+	delete(pprofUIs.handlers, id-maxPprofUIs)
+	return fmt.Sprintf("/pprofui/%d/flamegraph", id), nil
+}
+
+// servePprofUI serves the pages of the pprof web interface,
+// at /pprofui/<id>/<page>, for the profiles started by startPprofUI.
+func servePprofUI(w http.ResponseWriter, r *http.Request) {
+	elems := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/pprofui/"), "/", 2)
+	id, err := strconv.Atoi(elems[0])
+	if err != nil || len(elems) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	pprofUIs.Lock()
+	handlers := pprofUIs.handlers[id]
+	pprofUIs.Unlock()
+	if handlers == nil {
+		http.Error(w, "profile expired; reload it from the trace viewer", http.StatusNotFound)
+		return
+	}
+	h := handlers["/"+elems[1]]
+	if h == nil {
+		http.NotFound(w, r)
+		return
+	}
+	r.URL.Path = "/" + elems[1]
+	h.ServeHTTP(w, r)
+}
+
+// pprofUIFetcher implements driver.Fetcher, returning the profile
+// computed from the trace whatever the source.
+type pprofUIFetcher struct {
+	p *profile.Profile
+}
+
+func (f pprofUIFetcher) Fetch(src string, duration, timeout time.Duration) (*profile.Profile, string, error) {
+	return f.p, src, nil
+}
+
+// pprofUISilent implements driver.UI for the in-process pprof driver,
+// which has no terminal and must not open a browser.
+type pprofUISilent struct{}
+
+func (pprofUISilent) ReadLine(prompt string) (string, error)       { return "", fmt.Errorf("no terminal") }
+func (pprofUISilent) Print(...interface{})                         {}
+func (pprofUISilent) PrintErr(...interface{})                      {}
+func (pprofUISilent) IsTerminal() bool                             { return false }
+func (pprofUISilent) WantBrowser() bool                            { return false }
+func (pprofUISilent) SetAutoComplete(complete func(string) string) {}
+
+// pprofUIFlags implements driver.FlagSet, parsing a fixed command line.
+type pprofUIFlags struct {
+	*flag.FlagSet
+	args []string
+}
+
+func newPprofUIFlags(args ...string) *pprofUIFlags {
+	f := flag.NewFlagSet("pprof", flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	return &pprofUIFlags{FlagSet: f, args: args}
+}
+
+func (f *pprofUIFlags) StringList(name, def, usage string) *[]*string {
+	return &[]*string{f.String(name, def, usage)}
+}
+
+func (f *pprofUIFlags) ExtraUsage() string {
+	return ""
+}
+
+func (f *pprofUIFlags) Parse(usage func()) []string {
+	if err := f.FlagSet.Parse(f.args); err != nil {
+		usage()
+		return nil
+	}
+	return f.FlagSet.Args()
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"internal/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPprofUI(t *testing.T) {
+	events := []*trace.Event{blockEvent(1, 0, int64(time.Millisecond), 1, "main.f")}
+	p, err := computeProfile(profileBlock, events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	path, err := startPprofUI(p)
+	if err != nil {
+		t.Fatalf("startPprofUI failed: %v", err)
+	}
+	for _, tc := range []struct {
+		url  string
+		code int
+	}{
+		{path, http.StatusOK},
+		{"/pprofui/-1/flamegraph", http.StatusNotFound},
+		{"/pprofui/x", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		servePprofUI(rec, httptest.NewRequest("GET", tc.url, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s: got status %d; want %d", tc.url, rec.Code, tc.code)
+		}
+	}
+}
@@ -5,8 +5,14 @@
 package main
 
 import (
+	"compress/gzip"
 	"internal/trace"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -172,3 +178,160 @@ func TestPreemptedMarkAssist(t *testing.T) {
 		t.Errorf("Got %v MARK ASSIST events, want %v", marks, 2)
 	}
 }
+
+// TestMergeTraces tests the timestamps and the goroutine, stack and task
+// ids of merged traces do not collide.
+func TestMergeTraces(t *testing.T) {
+	newTrace := func() trace.ParseResult {
+		stk := []*trace.Frame{{Fn: "main.f"}}
+		create := &trace.Event{Type: trace.EvGoCreate, Ts: 0, G: 1, StkID: 1, Stk: stk, Args: [3]uint64{2, 1}}
+		task := &trace.Event{Type: trace.EvUserTaskCreate, Ts: 5, G: 2, Args: [3]uint64{1, 0}}
+		end := &trace.Event{Type: trace.EvGoEnd, Ts: 10, G: 2}
+		return trace.ParseResult{
+			Events: []*trace.Event{create, task, end},
+			Stacks: map[uint64][]*trace.Frame{1: stk},
+		}
+	}
+	res := mergeTraces([]trace.ParseResult{newTrace(), newTrace()})
+
+	if len(res.Events) != 6 {
+		t.Fatalf("got %d events; want 6", len(res.Events))
+	}
+	for i := 1; i < len(res.Events); i++ {
+		if res.Events[i-1].Ts >= res.Events[i].Ts {
+			t.Errorf("event %d (ts=%d) is not after event %d (ts=%d)", i, res.Events[i].Ts, i-1, res.Events[i-1].Ts)
+		}
+	}
+	first, second := res.Events[0], res.Events[3]
+	if first.G == second.G || first.Args[0] == second.Args[0] {
+		t.Errorf("goroutine ids collide: %v and %v", first, second)
+	}
+	if first.StkID == second.StkID || len(res.Stacks) != 2 || res.Stacks[second.StkID] == nil {
+		t.Errorf("stack ids collide: %d and %d (stacks: %v)", first.StkID, second.StkID, res.Stacks)
+	}
+	if task1, task2 := res.Events[1], res.Events[4]; task1.Args[0] == task2.Args[0] || task2.Args[1] != 0 {
+		t.Errorf("task ids of %v and %v are not offset properly", task1, task2)
+	}
+}
+
+// TestMergedTraceEnd tests that an event left unfinished at the end of one
+// of several merged traces lasts until the end of its own trace only.
+func TestMergedTraceEnd(t *testing.T) {
+	// The goroutine started in the first trace is still running at its end.
+	newTrace := func(running bool) trace.ParseResult {
+		stk := []*trace.Frame{{PC: 1, Fn: "main.f"}}
+		ev := &trace.Event{Type: trace.EvGomaxprocs, Ts: 5, Args: [3]uint64{1}}
+		if running {
+			ev = &trace.Event{Type: trace.EvGoStart, Ts: 5, G: 1, StkID: 1, Stk: stk, Args: [3]uint64{1}}
+		}
+		return trace.ParseResult{
+			Events: []*trace.Event{
+				{Type: trace.EvGomaxprocs, Ts: 0, Args: [3]uint64{1}},
+				ev,
+				{Type: trace.EvGoSched, Ts: 100, G: 2},
+			},
+			Stacks: map[uint64][]*trace.Frame{1: stk},
+		}
+	}
+	results := []trace.ParseResult{newTrace(true), newTrace(false), newTrace(false)}
+	parseTrace() // fool loader.once.
+	defer func(res trace.ParseResult, traces []trace.ParseResult) {
+		loader.res, loader.traces = res, traces
+	}(loader.res, loader.traces)
+	loader.res = mergeTraces(results)
+	loader.traces = results
+
+	p, err := computeProfile(profileExec, loader.res.Events, nil, nil)
+	if err != nil {
+		t.Fatalf("computeProfile failed: %v", err)
+	}
+	if len(p.Sample) != 1 {
+		t.Fatalf("got %d samples; want 1", len(p.Sample))
+	}
+	if got := p.Sample[0].Value[1]; got != 95 {
+		t.Errorf("got delay %d; want 95, until the end of the first trace", got)
+	}
+}
+
+func TestTraceFileNames(t *testing.T) {
+	defer func(old string) { traceFile = old }(traceFile)
+	traceFile = "http://host/trace?a=1%2C2,trace.out"
+	want := []string{"http://host/trace?a=1%2C2", "trace.out"}
+	if got := traceFileNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("traceFileNames() = %q; want %q", got, want)
+	}
+}
+
+func TestOpenTraceURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/trace.out" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "trace data")
+	}))
+	defer ts.Close()
+
+	f, err := openTrace(ts.URL + "/trace.out")
+	if err != nil {
+		t.Fatalf("openTrace failed: %v", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "trace data" {
+		t.Errorf("read %q, %v; want %q", data, err, "trace data")
+	}
+
+	if _, err := openTrace(ts.URL + "/missing"); err == nil {
+		t.Errorf("openTrace succeeded for a missing trace")
+	}
+}
+
+// TestParseNewerTrace checks that traces written by a newer toolchain are
+// rejected with an error, rather than yielding empty profiles.
+func TestParseNewerTrace(t *testing.T) {
+	f, err := ioutil.TempFile("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = io.WriteString(f, "go 1.22 trace\x00\x00\x00")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseTraceFile(f.Name())
+	if err == nil || !strings.Contains(err.Error(), "unsupported trace file version") {
+		t.Errorf("parseTraceFile returned %v; want an unsupported version error", err)
+	}
+}
+
+func TestParseGzipTrace(t *testing.T) {
+	const name = "../../internal/trace/testdata/http_1_11_good"
+	want, err := parseTraceFile(name)
+	if err != nil {
+		t.Fatalf("failed to parse the trace: %v", err)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	zw := gzip.NewWriter(f)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	got, err := parseTraceFile(f.Name())
+	if err != nil {
+		t.Fatalf("failed to parse the gzipped trace: %v", err)
+	}
+	if len(got.Events) != len(want.Events) {
+		t.Errorf("got %d events from the gzipped trace; want %d", len(got.Events), len(want.Events))
+	}
+}